@@ -0,0 +1,125 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// isSSH checks if the url uses the ssh scheme.
+func (r RepoURL) isSSH() bool {
+	return strings.HasPrefix(string(r), "ssh://")
+}
+
+// isAnonymous checks if the url uses a scheme without
+// authentication, the git protocol or local files.
+func (r RepoURL) isAnonymous() bool {
+	return strings.HasPrefix(string(r), "git://") || strings.HasPrefix(string(r), "file://")
+}
+
+// sshUser returns the user of an ssh url, defaulting to git.
+func (r RepoURL) sshUser() string {
+	s := strings.TrimPrefix(string(r), "ssh://")
+	if i := strings.Index(s, "@"); i > 0 {
+		return s[:i]
+	}
+	return "git"
+}
+
+// auth returns the authentication method to use with the remote
+// repository. SSH urls authenticate with the configured private key,
+// other urls with the configured user and password, or the authentication
+// token. The fallback url authenticates with its own token only.
+// A nil AuthMethod is returned if no authentication is configured,
+// or the url doesn't support authentication.
+func (r *Repo) auth() (transport.AuthMethod, error) {
+	u := r.pullURL()
+	if u.isAnonymous() {
+		return nil, nil
+	}
+	if u.isSSH() {
+		callback, err := r.hostKeyCallback()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read known hosts: %v", err)
+		}
+		if r.KeyPath == "" {
+			if callback == nil {
+				// fallback to the ssh agent
+				return nil, nil
+			}
+			agent, err := ssh.NewSSHAgentAuth(u.sshUser())
+			if err != nil {
+				return nil, err
+			}
+			agent.HostKeyCallback = callback
+			return agent, nil
+		}
+		keys, err := ssh.NewPublicKeysFromFile(u.sshUser(), r.KeyPath, r.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		keys.HostKeyCallback = callback
+		return keys, nil
+	}
+
+	// the credentials of r.URL are not sent to the fallback
+	if r.fallback {
+		if r.FallbackToken == "" {
+			return nil, nil
+		}
+		return &http.BasicAuth{Username: "minigit", Password: r.FallbackToken}, nil
+	}
+
+	token := r.Token
+	if r.TokenFile != "" {
+		// read at each pull for rotated tokens to be used
+		data, err := gos.ReadFile(r.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read auth token file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	if r.User == "" && r.Password == "" && token == "" {
+		return nil, nil
+	}
+
+	auth := &http.BasicAuth{
+		Username: r.User,
+		Password: r.Password,
+	}
+	if auth.Username == "" {
+		auth.Username = "minigit" // anything except an empty string
+	}
+	if auth.Password == "" {
+		auth.Password = token
+	}
+	return auth, nil
+}
+
+// hostKeyCallback returns the verification of the ssh host keys:
+// against r.KnownHosts, or none if skipped. nil is returned for the
+// default verification against the known_hosts files of the user.
+func (r *Repo) hostKeyCallback() (gossh.HostKeyCallback, error) {
+	if r.InsecureSkipHostKeyCheck {
+		return gossh.InsecureIgnoreHostKey(), nil
+	}
+	if r.KnownHosts != "" {
+		return ssh.NewKnownHostsCallback(r.KnownHosts)
+	}
+	return nil, nil
+}
+
+// isAuthError checks if err is an authentication or authorization
+// failure, which attempting the pull again would not fix.
+func isAuthError(err error) bool {
+	switch err {
+	case transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed, transport.ErrInvalidAuthMethod:
+		return true
+	}
+	return false
+}
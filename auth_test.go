@@ -0,0 +1,211 @@
+package git
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// writeKey writes a new rsa private key to a temporary file
+// and returns its path.
+func writeKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	check(t, err)
+
+	f, err := ioutil.TempFile("", "id_rsa")
+	check(t, err)
+	defer f.Close()
+
+	err = pem.Encode(f, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	check(t, err)
+	return f.Name()
+}
+
+func TestAuth(t *testing.T) {
+	keyPath := writeKey(t)
+	defer os.Remove(keyPath)
+
+	// ssh url with key
+	repo := &Repo{URL: "ssh://deploy@github.com:user/repo", KeyPath: keyPath, Token: "token"}
+	auth, err := repo.auth()
+	check(t, err)
+	keys, ok := auth.(*ssh.PublicKeys)
+	if !ok {
+		t.Fatalf("Expected ssh public keys auth, found %T", auth)
+	}
+	if keys.User != "deploy" {
+		t.Errorf("Expected user deploy, found %v", keys.User)
+	}
+
+	// ssh url without key uses the ssh agent
+	repo = &Repo{URL: "ssh://git@github.com:user/repo", Token: "token"}
+	auth, err = repo.auth()
+	check(t, err)
+	if auth != nil {
+		t.Errorf("Expected nil auth, found %T", auth)
+	}
+
+	// missing key
+	repo = &Repo{URL: "ssh://git@github.com:user/repo", KeyPath: keyPath + ".missing"}
+	if _, err = repo.auth(); err == nil {
+		t.Errorf("Expected error for missing key but found nil")
+	}
+
+	// https url with token
+	repo = &Repo{URL: "https://github.com/user/repo", KeyPath: keyPath, Token: "token"}
+	auth, err = repo.auth()
+	check(t, err)
+	if _, ok := auth.(*http.BasicAuth); !ok {
+		t.Errorf("Expected basic auth, found %T", auth)
+	}
+
+	// https url with user and password
+	repo = &Repo{URL: "https://gitlab.example.com/user/repo", User: "deploy", Password: "secret", Token: "token"}
+	auth, err = repo.auth()
+	check(t, err)
+	basic, ok := auth.(*http.BasicAuth)
+	if !ok {
+		t.Fatalf("Expected basic auth, found %T", auth)
+	}
+	if basic.Username != "deploy" || basic.Password != "secret" {
+		t.Errorf("Expected deploy:secret, found %v:%v", basic.Username, basic.Password)
+	}
+
+	// https url without token
+	repo = &Repo{URL: "https://github.com/user/repo"}
+	auth, err = repo.auth()
+	check(t, err)
+	if auth != nil {
+		t.Errorf("Expected nil auth, found %T", auth)
+	}
+
+	// urls without authentication ignore the credentials
+	for _, url := range []RepoURL{"git://example.com/user/repo.git", "file:///srv/mirror/repo.git"} {
+		repo = &Repo{URL: url, User: "deploy", Password: "secret", Token: "token"}
+		auth, err = repo.auth()
+		check(t, err)
+		if auth != nil {
+			t.Errorf("Expected nil auth for %v, found %T", url, auth)
+		}
+	}
+}
+
+func TestAuthTokenFile(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	var mu sync.Mutex
+	var passwords []string
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_, password, _ := r.BasicAuth()
+		mu.Lock()
+		passwords = append(passwords, password)
+		mu.Unlock()
+		nethttp.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tokenFile := "/run/secrets/git-token"
+	repo := &Repo{URL: RepoURL(server.URL + "/user/repo.git"), Path: dir, Branch: "master", TokenFile: tokenFile}
+
+	// missing token file
+	expected := "cannot read auth token file: open /run/secrets/git-token: file does not exist"
+	if err := repo.Pull(); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %v found %v", expected, err)
+	}
+
+	// the token is read again at each pull
+	for _, token := range []string{"first-token", "rotated-token"} {
+		check(t, gittest.FakeOS.WriteFile(tokenFile, []byte(token+"\n"), os.FileMode(0600)))
+		mu.Lock()
+		passwords = nil
+		mu.Unlock()
+
+		if err := repo.Pull(); err == nil {
+			t.Fatalf("Expected pull of a missing repository to fail")
+		}
+
+		mu.Lock()
+		if len(passwords) == 0 || passwords[0] != token {
+			t.Errorf("Expected token %v found %v", token, passwords)
+		}
+		mu.Unlock()
+	}
+}
+
+// hostKey returns the public key of a new rsa key.
+func hostKey(t *testing.T) gossh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	check(t, err)
+	pub, err := gossh.NewPublicKey(&key.PublicKey)
+	check(t, err)
+	return pub
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	keyPath := writeKey(t)
+	defer os.Remove(keyPath)
+
+	known, unknown := hostKey(t), hostKey(t)
+	f, err := ioutil.TempFile("", "known_hosts")
+	check(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(knownhosts.Line([]string{"github.com"}, known) + "\n")
+	check(t, err)
+	check(t, f.Close())
+
+	tests := []struct {
+		repo      *Repo
+		known     bool // the known host key is accepted
+		unknown   bool // the unknown host key is accepted
+		defaulted bool // the callback is left to go-git
+	}{
+		{&Repo{}, false, false, true},
+		{&Repo{KnownHosts: f.Name()}, true, false, false},
+		{&Repo{InsecureSkipHostKeyCheck: true}, true, true, false},
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(140, 82, 121, 3), Port: 22}
+	for i, test := range tests {
+		test.repo.URL = "ssh://git@github.com:user/repo"
+		test.repo.KeyPath = keyPath
+		auth, err := test.repo.auth()
+		check(t, err)
+		callback := auth.(*ssh.PublicKeys).HostKeyCallback
+		if test.defaulted {
+			if callback != nil {
+				t.Errorf("Test %v: expected default callback", i)
+			}
+			continue
+		}
+		if err := callback("github.com:22", addr, known); (err == nil) != test.known {
+			t.Errorf("Test %v: expected known host key accepted %v found %v", i, test.known, err)
+		}
+		if err := callback("github.com:22", addr, unknown); (err == nil) != test.unknown {
+			t.Errorf("Test %v: expected unknown host key accepted %v found %v", i, test.unknown, err)
+		}
+	}
+
+	repo := &Repo{URL: "ssh://git@github.com:user/repo", KeyPath: keyPath, KnownHosts: f.Name() + ".missing"}
+	if _, err := repo.auth(); err == nil {
+		t.Error("Expected missing known_hosts error")
+	}
+}
@@ -0,0 +1,88 @@
+package git
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// execBefore executes r.Before ahead of a pull, unless no change of the
+// files is likely and r.BeforeAlways is not set. The first failure
+// is returned, the pull must then be aborted. r must be locked.
+func (r *Repo) execBefore(ctx context.Context) error {
+	if len(r.Before) == 0 || (!r.BeforeAlways && !r.changeLikely(ctx)) {
+		return nil
+	}
+
+	env := r.thenEnv()
+	for _, command := range r.Before {
+		ctx, cancel := r.thenContext()
+		err := execCommand(ctx, command, r.Path, env)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("pull of %v aborted, before command '%v' failed: %v", r.label(), command.Command(), err)
+		}
+		Logger().Printf("Before command '%v' successful.\n", command.Command())
+	}
+	return nil
+}
+
+// changeLikely checks if the next pull is likely to change the files of
+// r: the head of the remote branch is not the last commit, or it cannot
+// be told before r.Timeout or ctx is done. Only the branch is checked,
+// tags and pinned revisions are assumed to change.
+func (r *Repo) changeLikely(ctx context.Context) bool {
+	if !r.pulled || r.lastCommit == "" || r.detached() {
+		return true
+	}
+
+	auth, err := r.auth()
+	if err != nil {
+		return true
+	}
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return true
+	}
+	remote, err := gr.Remote(r.remoteName())
+	if err != nil {
+		return true
+	}
+
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	// the listing takes no context, a hung remote is left behind
+	type listing struct {
+		refs []*plumbing.Reference
+		err  error
+	}
+	listed := make(chan listing, 1)
+	go func() {
+		refs, err := remote.List(&git.ListOptions{Auth: auth})
+		listed <- listing{refs, err}
+	}()
+	var refs []*plumbing.Reference
+	select {
+	case l := <-listed:
+		if l.err != nil {
+			return true
+		}
+		refs = l.refs
+	case <-ctx.Done():
+		return true
+	}
+
+	branch := plumbing.NewBranchReferenceName(r.Branch)
+	for _, ref := range refs {
+		if ref.Name() == branch {
+			return ref.Hash().String() != r.lastCommit
+		}
+	}
+	return true
+}
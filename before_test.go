@@ -0,0 +1,146 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+)
+
+// readThen is a Then recording the content of index.html
+// at each execution, failing with err.
+type readThen struct {
+	contents []string
+	err      error
+}
+
+func (r *readThen) Command() string { return "read" }
+func (r *readThen) Exec(dir string) error {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	r.contents = append(r.contents, string(data))
+	return r.err
+}
+
+func TestBefore(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	before := &readThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Before = []Then{before}
+
+	// executed before the clone
+	check(t, repo.Pull())
+	remote.commit(t, "index.html", "second")
+	check(t, repo.Pull())
+	if strings.Join(before.contents, ",") != ",first" {
+		t.Errorf("Expected before executed prior to the pulls found %q", before.contents)
+	}
+
+	// no change
+	check(t, repo.Pull())
+	if len(before.contents) != 2 {
+		t.Errorf("Expected before not executed without changes, found %v executions", len(before.contents))
+	}
+	repo.BeforeAlways = true
+	check(t, repo.Pull())
+	if len(before.contents) != 3 {
+		t.Errorf("Expected before always executed, found %v executions", len(before.contents))
+	}
+
+	// the failure aborts the pull
+	last := repo.lastCommit
+	remote.commit(t, "index.html", "third")
+	before.err = os.ErrPermission
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("Expected aborted pull found %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	check(t, err)
+	if string(data) != "second" || repo.lastCommit != last {
+		t.Errorf("Expected commit %v not pulled found %v with %q", last, repo.lastCommit, data)
+	}
+}
+
+// hangingTransport is a go-git transport whose sessions hang
+// until it is closed.
+type hangingTransport chan struct{}
+
+func (h hangingTransport) NewUploadPackSession(*transport.Endpoint, transport.AuthMethod) (transport.UploadPackSession, error) {
+	<-h
+	return nil, transport.ErrRepositoryNotFound
+}
+
+func (h hangingTransport) NewReceivePackSession(*transport.Endpoint, transport.AuthMethod) (transport.ReceivePackSession, error) {
+	<-h
+	return nil, transport.ErrRepositoryNotFound
+}
+
+func TestChangeLikelyHung(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	hung := make(hangingTransport)
+	defer close(hung)
+	client.InstallProtocol("hanging", hung)
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	// the remote stops answering
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	check(t, gr.DeleteRemote(repo.remoteName()))
+	_, err = gr.CreateRemote(&config.RemoteConfig{Name: repo.remoteName(), URLs: []string{"hanging://host/repo.git"}})
+	check(t, err)
+
+	tests := []struct {
+		timeout time.Duration
+		cancel  bool
+	}{
+		{50 * time.Millisecond, false},
+		{0, true},
+	}
+
+	for i, test := range tests {
+		repo.Timeout = test.timeout
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		likely := make(chan bool, 1)
+		go func() { likely <- repo.changeLikely(ctx) }()
+		select {
+		case l := <-likely:
+			if !l {
+				t.Errorf("Test %v: Expected change likely when the remote hangs", i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Test %v: Expected changeLikely to return once done, still listing", i)
+		}
+		cancel()
+	}
+}
@@ -3,7 +3,6 @@ package git
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -13,6 +12,10 @@ import (
 )
 
 // BitbucketHook is webhook for BitBucket.org.
+// Bitbucket doesn't sign requests, the hook secret may be
+// set to a comma separated list of IPs or CIDR blocks allowed
+// to send webhooks instead. Atlassian's published IP ranges
+// are allowed otherwise.
 type BitbucketHook struct{}
 
 type bbPush struct {
@@ -20,11 +23,21 @@ type bbPush struct {
 		Changes []struct {
 			New struct {
 				Name string `json:"name,omitempty"`
+				Type string `json:"type,omitempty"`
 			} `json:"new,omitempty"`
+			Old struct {
+				Name string `json:"name,omitempty"`
+			} `json:"old,omitempty"`
+			Closed bool `json:"closed,omitempty"`
 		} `json:"changes,omitempty"`
 	} `json:"push,omitempty"`
 }
 
+// RequiresSecret satisfies hookHandler.
+func (b BitbucketHook) RequiresSecret() bool {
+	return false
+}
+
 // DoesHandle satisfies hookHandler.
 func (b BitbucketHook) DoesHandle(h http.Header) bool {
 	event := h.Get("X-Event-Key")
@@ -38,7 +51,7 @@ func (b BitbucketHook) DoesHandle(h http.Header) bool {
 
 // Handle satisfies hookHandler.
 func (b BitbucketHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
-	if !b.verifyBitbucketIP(r.RemoteAddr) {
+	if !b.verifyIP(r.RemoteAddr, repo.Hook.Secret) {
 		return http.StatusForbidden, errors.New("the request doesn't come from a valid IP")
 	}
 
@@ -58,16 +71,11 @@ func (b BitbucketHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo
 
 	switch event {
 	case "repo:push":
-		err = b.handlePush(body, repo)
-		if !hookIgnored(err) && err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(b.handlePush(body, repo))
 	default:
 		// return 400 if we do not handle the event type.
 		return http.StatusBadRequest, nil
 	}
-
-	return http.StatusOK, err
 }
 
 func (b BitbucketHook) handlePush(body []byte, repo *Repo) error {
@@ -82,19 +90,28 @@ func (b BitbucketHook) handlePush(body []byte, repo *Repo) error {
 		return errors.New("the push was incomplete, missing change list")
 	}
 
-	change := push.Push.Changes[0]
-	if len(change.New.Name) == 0 {
-		return errors.New("the push didn't contain a valid branch name")
-	}
-
-	branch := change.New.Name
-	if branch != repo.Branch {
-		return hookIgnoredError{hookType: hookName(b), err: fmt.Errorf("found different branch %v", branch)}
+	// a push may update several branches and tags,
+	// pull if any of them is pulled by repo.
+	var names []string
+	for _, change := range push.Push.Changes {
+		// deleted branches and tags have no new name
+		if change.Closed || (change.New.Name == "" && change.Old.Name != "") {
+			names = append(names, change.Old.Name)
+			continue
+		}
+		if len(change.New.Name) == 0 {
+			return errors.New("the push didn't contain a valid branch name")
+		}
+		ref := "refs/heads/" + change.New.Name
+		if change.New.Type == "tag" {
+			ref = "refs/tags/" + change.New.Name
+		}
+		if repo.wantsRef(ref) {
+			return pullHook(repo, nil)
+		}
+		names = append(names, change.New.Name)
 	}
-	Logger().Print("Received pull notification for the tracking branch, updating...\n")
-	repo.Pull()
-
-	return nil
+	return branchIgnored(b, strings.Join(names, ", "))
 }
 
 func hostOnly(remoteAddr string) string {
@@ -105,9 +122,26 @@ func hostOnly(remoteAddr string) string {
 	return host
 }
 
-func (b BitbucketHook) verifyBitbucketIP(remoteAddr string) bool {
-	ipAddress := net.ParseIP(hostOnly(remoteAddr))
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIP checks if remoteAddr is allowed to send webhooks. allowed is
+// a comma separated list of IPs and CIDR blocks; Atlassian's IP ranges
+// are used if it is empty.
+func (b BitbucketHook) verifyIP(remoteAddr, allowed string) bool {
+	if allowed != "" {
+		return ipAllowed(remoteAddr, strings.Split(allowed, ","))
+	}
+	return b.verifyBitbucketIP(remoteAddr)
+}
 
+func (b BitbucketHook) verifyBitbucketIP(remoteAddr string) bool {
 	updateBitBucketIPs()
 
 	atlassianIPsMu.Lock()
@@ -120,19 +154,33 @@ func (b BitbucketHook) verifyBitbucketIP(remoteAddr string) bool {
 		return true
 	}
 
-	for _, item := range ipItems {
+	cidrs := make([]string, len(ipItems))
+	for i, item := range ipItems {
+		cidrs[i] = item.CIDR
+	}
+	return ipAllowed(remoteAddr, cidrs)
+}
+
+// ipAllowed checks if the ip of remoteAddr is one of the
+// IPs or in one of the CIDR blocks of cidrs.
+func ipAllowed(remoteAddr string, cidrs []string) bool {
+	ipAddress := net.ParseIP(hostOnly(remoteAddr))
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+
 		// it may be regular ip address
-		if !strings.Contains(item.CIDR, "/") {
-			ip := net.ParseIP(item.CIDR)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
 			if ip.Equal(ipAddress) {
 				return true
 			}
 			continue
 		}
 
-		_, cidrnet, err := net.ParseCIDR(item.CIDR)
+		_, cidrnet, err := net.ParseCIDR(cidr)
 		if err != nil {
-			Logger().Printf("Error parsing CIDR block [%s]. Skipping...\n", item.CIDR)
+			Logger().Printf("Error parsing CIDR block [%s]. Skipping...\n", cidr)
 			continue
 		}
 
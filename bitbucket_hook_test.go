@@ -9,7 +9,7 @@ import (
 )
 
 func TestBitbucketDeployPush(t *testing.T) {
-	repo := &Repo{Branch: "master", Hook: HookConfig{URL: "/bitbucket_deploy"}}
+	repo := pulledRepo(HookConfig{URL: "/bitbucket_deploy"})
 	bbHook := BitbucketHook{}
 
 	remoteIP := "18.246.31.128"
@@ -48,6 +48,10 @@ func TestBitbucketDeployPush(t *testing.T) {
 		{remoteIP, pushBBBodyValid, "repo:push", "", 200},
 		{remoteIP, pushBBBodyEmptyBranch, "repo:push", "", 400},
 		{remoteIP, pushBBBodyDeleteBranch, "repo:push", "", 400},
+		{remoteIP, pushBBBodyOther, "repo:push", "", 200},
+		{remoteIP, pushBBBodyMultiple, "repo:push", "", 200},
+		{remoteIP, pushBBBodyDeletedRef, "repo:push", "", 200},
+		{remoteIP, pushBBBodyDeletedRefs, "repo:push", "", 200},
 	} {
 
 		req, err := http.NewRequest("POST", "/bitbucket_deploy", bytes.NewBuffer([]byte(test.body)))
@@ -75,6 +79,46 @@ func TestBitbucketDeployPush(t *testing.T) {
 
 }
 
+func TestBitbucketAllowedIPs(t *testing.T) {
+	repo := pulledRepo(HookConfig{
+		URL:    "/bitbucket_deploy",
+		Secret: "10.0.0.0/24, 192.168.1.5,2001:db8::/32",
+	})
+	bbHook := BitbucketHook{}
+
+	for i, test := range []struct {
+		ip      string
+		body    string
+		code    int
+		ignored bool
+	}{
+		{"10.0.0.12:4567", pushBBBodyValid, 200, false},
+		{"10.0.1.12:4567", pushBBBodyValid, 403, false},
+		{"192.168.1.5:4567", pushBBBodyValid, 200, false},
+		{"192.168.1.6:4567", pushBBBodyValid, 403, false},
+		{"[2001:db8::1]:4567", pushBBBodyValid, 200, false},
+		{"18.246.31.128:4567", pushBBBodyValid, 403, false}, // atlassian ips are not used
+		{"10.0.0.12:4567", pushBBBodyOther, 200, true},
+		{"10.0.0.12:4567", pushBBBodyDeletedRef, 200, false},
+		{"10.0.0.12:4567", pushBBBodyDeletedRefs, 200, true},
+	} {
+		req, err := http.NewRequest("POST", "/bitbucket_deploy", bytes.NewBuffer([]byte(test.body)))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.RemoteAddr = test.ip
+		req.Header.Add("X-Event-Key", "repo:push")
+
+		code, err := bbHook.Handle(httptest.NewRecorder(), req, repo)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+		if hookIgnored(err) != test.ignored {
+			t.Errorf("Test %d: Expected webhook ignored to be %v but found error %v", i, test.ignored, err)
+		}
+	}
+}
+
 var pushBBBodyEmptyBranch = `
 {
 	"push": {
@@ -119,3 +163,102 @@ var pushBBBodyDeleteBranch = `
 	}
 }
 `
+
+var pushBBBodyOther = `
+{
+	"actor": {
+		"display_name": "John Smith",
+		"type": "user"
+	},
+	"repository": {
+		"full_name": "team/repo",
+		"type": "repository"
+	},
+	"push": {
+		"changes": [
+			{
+				"new": {
+					"type": "branch",
+					"name": "develop",
+					"target": {
+						"type": "commit",
+						"hash": "709d658dc5b6d6afcd46049c2f332ee3f515a67d"
+					}
+				},
+				"old": {
+					"type": "branch",
+					"name": "develop",
+					"target": {
+						"type": "commit",
+						"hash": "1e65c05c1d5171631d92438a13901ca7dae9618c"
+					}
+				},
+				"created": false,
+				"forced": false,
+				"closed": false
+			}
+		]
+	}
+}
+`
+
+var pushBBBodyMultiple = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": {
+					"type": "branch",
+					"name": "develop"
+				}
+			},
+			{
+				"new": {
+					"type": "branch",
+					"name": "master"
+				}
+			}
+		]
+	}
+}
+`
+
+var pushBBBodyDeletedRef = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": null,
+				"old": {
+					"type": "branch",
+					"name": "feature"
+				},
+				"closed": true
+			},
+			{
+				"new": {
+					"type": "branch",
+					"name": "master"
+				}
+			}
+		]
+	}
+}
+`
+
+var pushBBBodyDeletedRefs = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": null,
+				"old": {
+					"type": "tag",
+					"name": "v1.0.0"
+				},
+				"closed": true
+			}
+		]
+	}
+}
+`
@@ -0,0 +1,165 @@
+package git
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// BranchSpec is an additional branch of the repository
+// checked out into a subdirectory of the repository path.
+type BranchSpec struct {
+	Branch     string // Git branch
+	Path       string // Directory to check out to, relative to the repository path
+	lastCommit string // hash of the checked out commit
+}
+
+// branchPath returns the directory b is checked out to.
+func (r *Repo) branchPath(b *BranchSpec) string {
+	return filepath.Join(r.Path, b.Path)
+}
+
+// checkoutBranches checks out the latest commit of each of r.Branches
+// into its directory. It returns true if any of the branches changed.
+func (r *Repo) checkoutBranches() (bool, error) {
+	if len(r.Branches) == 0 {
+		return false, nil
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return false, err
+	}
+
+	var changed bool
+	var errs error
+	for _, b := range r.Branches {
+		c, err := r.checkoutBranch(gr, b)
+		changed = changed || c
+		errs = mergeErrors(errs, err)
+	}
+	return changed, errs
+}
+
+// checkoutBranch checks out the latest fetched commit of b into its
+// directory. The files are written directly, leaving HEAD of the
+// repository untouched.
+func (r *Repo) checkoutBranch(gr *git.Repository, b *BranchSpec) (bool, error) {
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), b.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return false, r.branchNotFound(b.Branch)
+	}
+	if err != nil {
+		return false, err
+	}
+	if ref.Hash().String() == b.lastCommit {
+		return false, nil
+	}
+
+	commit, err := gr.CommitObject(ref.Hash())
+	if err != nil {
+		return false, err
+	}
+
+	// files of the previous commit which are missing
+	// from the new one are removed
+	var previous *object.Commit
+	if b.lastCommit != "" {
+		previous, err = gr.CommitObject(plumbing.NewHash(b.lastCommit))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	dir := r.branchPath(b)
+	if err := exportCommit(commit, previous, dir); err != nil {
+		return false, err
+	}
+
+	b.lastCommit = commit.Hash.String()
+	Logger().Printf("%v branch %v checked out to %v.\n", r.label(), b.Branch, dir)
+	return true, nil
+}
+
+// exportCommit writes the files of commit into dir and removes
+// the files of previous which are not part of commit. Symbolic
+// links are recreated as such. previous may be nil.
+func exportCommit(commit, previous *object.Commit, dir string) error {
+	return exportFiles(commit, previous, dir, nil)
+}
+
+// exportFiles is exportCommit limited to the files for which keep
+// returns true. All the files are exported if keep is nil.
+func exportFiles(commit, previous *object.Commit, dir string, keep func(string) bool) error {
+	fs := osfs.New(dir)
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if keep != nil && !keep(f.Name) {
+			return nil
+		}
+		files[f.Name] = true
+
+		// symbolic links are recreated, never written through
+		if info, err := fs.Lstat(f.Name); err == nil && (info.Mode()&os.ModeSymlink != 0 || f.Mode == filemode.Symlink) {
+			if err := fs.Remove(f.Name); err != nil {
+				return err
+			}
+		}
+		if f.Mode == filemode.Symlink {
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return fs.Symlink(target, f.Name)
+		}
+
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		src, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := fs.OpenFile(f.Name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	})
+	if err != nil || previous == nil {
+		return err
+	}
+
+	tree, err = previous.Tree()
+	if err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(f *object.File) error {
+		if files[f.Name] || (keep != nil && !keep(f.Name)) {
+			return nil
+		}
+		if err := fs.Remove(f.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,183 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestBranches(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	remote.commit(t, "index.html", "master")
+	remote.checkout(t, "staging")
+	remote.commit(t, "index.html", "staging")
+	remote.commit(t, "draft.html", "draft")
+	remote.checkout(t, "master")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Branches = []*BranchSpec{{Branch: "staging", Path: "/preview"}}
+
+	check(t, repo.Pull())
+
+	content := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+
+	for name, expected := range map[string]string{
+		"index.html":         "master",
+		"draft.html":         "",
+		"preview/index.html": "staging",
+		"preview/draft.html": "draft",
+	} {
+		if c := content(name); c != expected {
+			t.Errorf("Expected %v to contain '%v' found '%v'", name, expected, c)
+		}
+	}
+
+	// update the staging branch only
+	remote.checkout(t, "staging")
+	remote.remove(t, "draft.html")
+	remote.commit(t, "index.html", "staging 2")
+	remote.checkout(t, "master")
+
+	check(t, repo.Pull())
+
+	for name, expected := range map[string]string{
+		"index.html":         "master",
+		"preview/index.html": "staging 2",
+		"preview/draft.html": "",
+	} {
+		if c := content(name); c != expected {
+			t.Errorf("Expected %v to contain '%v' found '%v'", name, expected, c)
+		}
+	}
+
+	// unknown branch
+	repo.Branches = append(repo.Branches, &BranchSpec{Branch: "missing", Path: "missing"})
+	if _, err := repo.checkoutBranches(); err == nil {
+		t.Errorf("Expected error for missing branch but found nil")
+	}
+}
+
+func TestBranchesSymlink(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	remote.commit(t, "index.html", "master")
+	remote.checkout(t, "staging")
+	remote.commit(t, "index.html", "staging")
+
+	// current links to index.html
+	check(t, os.Symlink("index.html", filepath.Join(remote.dir, "current")))
+	w, err := remote.repo.Worktree()
+	check(t, err)
+	_, err = w.Add("current")
+	check(t, err)
+	_, err = w.Commit("link current", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	check(t, err)
+	remote.checkout(t, "master")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Branches = []*BranchSpec{{Branch: "staging", Path: "/preview"}}
+	check(t, repo.Pull())
+
+	link := filepath.Join(dir, "preview", "current")
+	if target, err := os.Readlink(link); err != nil || target != "index.html" {
+		t.Errorf("Expected %v linked to index.html found %q %v", link, target, err)
+	}
+
+	// the link replaced by a file is not written through
+	remote.checkout(t, "staging")
+	check(t, os.Remove(filepath.Join(remote.dir, "current")))
+	remote.commit(t, "current", "current")
+	remote.checkout(t, "master")
+	check(t, repo.Pull())
+
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("Expected %v replaced by a file found %v", link, err)
+	}
+	for name, expected := range map[string]string{
+		"preview/current":    "current",
+		"preview/index.html": "staging",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != expected {
+			t.Errorf("Expected %v to contain '%v' found '%s' %v", name, expected, b, err)
+		}
+	}
+}
+
+func TestSwitchBranch(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	remote.commit(t, "index.html", "master")
+	remote.checkout(t, "develop")
+	develop := remote.commit(t, "index.html", "develop")
+	remote.checkout(t, "master")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	// the branch is changed in the configuration
+	repo.Branch = "develop"
+	check(t, repo.Pull())
+
+	if repo.lastCommit != develop {
+		t.Errorf("Expected last commit %v found %v", develop, repo.lastCommit)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	check(t, err)
+	if string(b) != "develop" {
+		t.Errorf("Expected index.html to contain 'develop' found '%s'", b)
+	}
+
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	head, err := gr.Head()
+	check(t, err)
+	if head.Name() != plumbing.NewBranchReferenceName("develop") {
+		t.Errorf("Expected HEAD on develop found %v", head.Name())
+	}
+
+	// the local branch tracks the remote one
+	remote.checkout(t, "develop")
+	develop = remote.commit(t, "index.html", "develop 2")
+	remote.checkout(t, "master")
+	check(t, repo.Pull())
+	if repo.lastCommit != develop {
+		t.Errorf("Expected last commit %v found %v", develop, repo.lastCommit)
+	}
+}
@@ -0,0 +1,95 @@
+package git
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// NewChangedThen creates a new Then command executed only if one of the
+// files changed by the pull matches the glob pattern.
+func NewChangedThen(pattern, command string, args ...string) Then {
+	return &changedThen{pattern: pattern, Then: NewThen(command, args...)}
+}
+
+// changedThen is a Then command conditioned on the changed files.
+type changedThen struct {
+	Then
+	pattern string
+}
+
+// ExecContext executes the conditioned command.
+func (c *changedThen) ExecContext(ctx context.Context, dir string, env []string) error {
+	return execCommand(ctx, c.Then, dir, env)
+}
+
+// runs reports whether the command runs after a pull changing the
+// files changed, which are unknown if nil.
+func (c *changedThen) runs(changed []string) bool {
+	if changed == nil {
+		return true
+	}
+	for _, name := range changed {
+		if matchChanged(c.pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchChanged checks if the file name or one of its parent
+// directories matches the glob pattern, e.g. content matches
+// content/posts/first.md.
+func matchChanged(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	for name != "." && name != "/" && name != "" {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// changedFiles returns the sorted names of the files added, modified
+// or deleted between the commits from and to of the repository.
+func (r *Repo) changedFiles(from, to string) ([]string, error) {
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var trees [2]*object.Tree
+	for i, hash := range []string{from, to} {
+		commit, err := gr.CommitObject(plumbing.NewHash(hash))
+		if err != nil {
+			return nil, err
+		}
+		if trees[i], err = commit.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := trees[0].DiffContext(context.Background(), trees[1])
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, change := range changes {
+		names[change.From.Name] = true
+		names[change.To.Name] = true
+	}
+	delete(names, "")
+
+	changed := make([]string, 0, len(names))
+	for name := range names {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
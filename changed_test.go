@@ -0,0 +1,110 @@
+package git
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestMatchChanged(t *testing.T) {
+	for i, test := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"content", "content/posts/first.md", true},
+		{"content/", "content/posts/first.md", true},
+		{"content/*", "content/posts/first.md", true},
+		{"content/*.md", "content/index.md", true},
+		{"content/*.md", "content/posts/first.md", false},
+		{"*.scss", "style.scss", true},
+		{"*.scss", "assets/style.scss", false},
+		{"content", "static/content.md", false},
+		{"content", "contents/index.md", false},
+	} {
+		if match := matchChanged(test.pattern, test.name); match != test.match {
+			t.Errorf("Test %v: expected %v matching %v to be %v", i, test.pattern, test.name, test.match)
+		}
+	}
+}
+
+func TestChangedThen(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	build := &countThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Then = []Then{&changedThen{pattern: "content", Then: build}}
+
+	// executed after the first clone
+	check(t, repo.Pull())
+	if build.n != 1 {
+		t.Fatalf("Expected command executed after the first clone found %v", build.n)
+	}
+
+	for i, test := range []struct {
+		name     string
+		remove   bool
+		expected int
+	}{
+		{"about.html", false, 1},
+		{"content/posts/first.md", false, 2},
+		{"static/style.css", false, 2},
+		{"content/posts/first.md", true, 3},
+	} {
+		if test.remove {
+			remote.remove(t, test.name)
+		} else {
+			remote.commit(t, test.name, test.name)
+		}
+		check(t, repo.Pull())
+		if build.n != test.expected {
+			t.Errorf("Test %v: expected command executed %v times found %v", i, test.expected, build.n)
+		}
+	}
+}
+
+func TestChangedFilesEnv(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+	remote.commit(t, "old.html", "old")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	then := &countThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Then = []Then{then}
+
+	// unknown after the first clone
+	check(t, repo.Pull())
+	for _, env := range then.env {
+		if strings.HasPrefix(env, "CADDY_GIT_CHANGED_FILES=") {
+			t.Errorf("Expected no changed files after the first clone found %v", env)
+		}
+	}
+
+	// two commits are pulled at once
+	remote.commit(t, "index.html", "second")
+	remote.commit(t, "content/posts/first.md", "post")
+	remote.remove(t, "old.html")
+	check(t, repo.Pull())
+
+	expected := "CADDY_GIT_CHANGED_FILES=content/posts/first.md\nindex.html\nold.html"
+	if !containsString(then.env, expected) {
+		t.Errorf("Expected environment to contain %q found %q", expected, then.env)
+	}
+}
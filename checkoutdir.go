@@ -0,0 +1,90 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// releaseDir returns the directory the commit is checked
+// out to, swapped into r.CheckoutDir once complete.
+func (r *Repo) releaseDir(commit string) string {
+	return fmt.Sprintf("%v.%v", r.CheckoutDir, commit[:12])
+}
+
+// deployCheckout checks out the most recent commit into r.CheckoutDir
+// if it is set and the commit is not deployed yet. The files are written
+// to a new release directory first, then r.CheckoutDir, a symbolic link
+// to the release directory, is atomically replaced. A failed checkout
+// leaves the deployed files untouched.
+func (r *Repo) deployCheckout() error {
+	if r.CheckoutDir == "" || r.deployedCommit == r.lastCommit {
+		return nil
+	}
+
+	release := r.releaseDir(r.lastCommit)
+	previous, err := gos.Readlink(r.CheckoutDir)
+	switch {
+	case err == nil && previous == filepath.Base(release):
+		// deployed before a restart
+		r.deployedCommit = r.lastCommit
+		return nil
+	case err != nil && !os.IsNotExist(err):
+		return fmt.Errorf("checkout_dir %v is not a symbolic link: %v", r.CheckoutDir, err)
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return err
+	}
+	commit, err := gr.CommitObject(plumbing.NewHash(r.lastCommit))
+	if err != nil {
+		return err
+	}
+
+	// leftover of an interrupted checkout
+	if err := gos.RemoveAll(release); err != nil {
+		return err
+	}
+	if err := gos.MkdirAll(release, os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := exportCommit(commit, nil, release); err != nil {
+		removeLeftover(release)
+		return fmt.Errorf("checking out %v to %v failed: %v", r.lastCommit, release, err)
+	}
+
+	// renaming a link over the existing one is atomic
+	link := r.CheckoutDir + ".tmp"
+	if err := gos.Remove(link); err != nil && !os.IsNotExist(err) {
+		removeLeftover(release)
+		return err
+	}
+	if err := gos.Symlink(filepath.Base(release), link); err != nil {
+		removeLeftover(release)
+		return err
+	}
+	if err := gos.Rename(link, r.CheckoutDir); err != nil {
+		removeLeftover(link)
+		removeLeftover(release)
+		return err
+	}
+
+	if previous != "" {
+		removeLeftover(filepath.Join(filepath.Dir(r.CheckoutDir), previous))
+	}
+	r.deployedCommit = r.lastCommit
+	Logger().Printf("%v deployed to %v.\n", r.label(), r.CheckoutDir)
+	return nil
+}
+
+// removeLeftover removes the file or directory left by a deployment,
+// a failure is only logged.
+func removeLeftover(name string) {
+	if err := gos.RemoveAll(name); err != nil {
+		Logger().Printf("Removing %v failed: %v\n", name, err)
+	}
+}
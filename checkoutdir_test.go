@@ -0,0 +1,101 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gitos"
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestCheckoutDir(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the release directories and the link are swapped on disk
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	first := remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	site := tempDir(t)
+	defer os.RemoveAll(site)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.CheckoutDir = filepath.Join(site, "public")
+
+	served := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(repo.CheckoutDir, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	check(t, repo.Pull())
+	if s := served("index.html"); s != "first" {
+		t.Fatalf("Expected first commit deployed found %q", s)
+	}
+	if _, err := os.Stat(filepath.Join(repo.CheckoutDir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("Expected no git metadata deployed found %v", err)
+	}
+
+	// the release directory is swapped
+	second := remote.commit(t, "index.html", "second")
+	check(t, repo.Pull())
+	if s := served("index.html"); s != "second" {
+		t.Errorf("Expected second commit deployed found %q", s)
+	}
+	if target, err := os.Readlink(repo.CheckoutDir); err != nil || target != "public."+second[:12] {
+		t.Errorf("Expected link to the release of %v found %v %v", second, target, err)
+	}
+	if _, err := os.Stat(repo.releaseDir(first)); !os.IsNotExist(err) {
+		t.Errorf("Expected previous release removed found %v", err)
+	}
+
+	// a failed pull leaves the deployed files untouched
+	check(t, os.RemoveAll(remote.dir))
+	if err := repo.Pull(); err == nil {
+		t.Fatal("Expected pull of removed repo to fail")
+	}
+	if s := served("index.html"); s != "second" {
+		t.Errorf("Expected second commit still deployed found %q", s)
+	}
+	entries, err := ioutil.ReadDir(site)
+	check(t, err)
+	if len(entries) != 2 {
+		t.Errorf("Expected only the link and the release in %v found %v entries", site, len(entries))
+	}
+}
+
+func TestCheckoutDirNotLink(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the release directories and the link are swapped on disk
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	site := tempDir(t)
+	defer os.RemoveAll(site)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.CheckoutDir = site
+	if err := repo.Pull(); err == nil {
+		t.Error("Expected error deploying to a directory")
+	}
+	if _, err := os.Stat(filepath.Join(site, "index.html")); !os.IsNotExist(err) {
+		t.Errorf("Expected directory untouched found %v", err)
+	}
+}
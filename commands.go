@@ -2,18 +2,49 @@ package git
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/akhenakh/caddy-puregit/gitos"
 )
 
+// restartDelay is the delay before restarting a terminated
+// background command.
+const restartDelay = 5 * time.Second
+
 // Then is the command executed after successful pull.
 type Then interface {
 	Command() string
 	Exec(string) error
 }
 
+// ContextThen is a Then command supporting cancellation and the
+// environment of the pull. It is executed with ExecContext instead
+// of Exec.
+type ContextThen interface {
+	Then
+	// ExecContext executes the command from directory dir with the
+	// environment variables env added to the inherited ones.
+	// The command is killed when ctx is done, unless it runs
+	// in background.
+	ExecContext(ctx context.Context, dir string, env []string) error
+}
+
+// execCommand executes command from directory dir, with ctx and env
+// if command is a ContextThen.
+func execCommand(ctx context.Context, command Then, dir string, env []string) error {
+	if c, ok := command.(ContextThen); ok {
+		return c.ExecContext(ctx, dir, env)
+	}
+	return command.Exec(dir)
+}
+
 // NewThen creates a new Then command.
 func NewThen(command string, args ...string) Then {
 	return &gitCmd{command: command, args: args}
@@ -21,19 +52,18 @@ func NewThen(command string, args ...string) Then {
 
 // NewLongThen creates a new long running Then comand.
 func NewLongThen(command string, args ...string) Then {
-	return &gitCmd{command: command, args: args, background: true, haltChan: make(chan struct{})}
+	return &gitCmd{command: command, args: args, background: true}
 }
 
 type gitCmd struct {
 	command    string
 	args       []string
-	dir        string
 	background bool
-	process    *os.Process
 
-	haltChan   chan struct{}
-	monitoring bool
-	sync.RWMutex
+	// running background process, stopped by closing halt
+	halt chan struct{}
+	done chan struct{}
+	sync.Mutex
 }
 
 // Command returns the full command as configured in Caddyfile.
@@ -43,159 +73,212 @@ func (g *gitCmd) Command() string {
 
 // Exec executes the command initiated in gitCmd.
 func (g *gitCmd) Exec(dir string) error {
-	g.Lock()
-	g.dir = dir
-	g.Unlock()
-
-	if g.background {
-		return g.execBackground(dir)
-	}
-	return g.exec(dir)
+	return g.ExecContext(context.Background(), dir, nil)
 }
 
-func (g *gitCmd) restart() error {
-	err := g.Exec(g.dir)
-	if err == nil {
-		Logger().Printf("Restart successful for '%v'.\n", g.Command())
-	} else {
-		Logger().Printf("Restart failed for '%v'.\n", g.Command())
+// ExecContext executes the command initiated in gitCmd.
+func (g *gitCmd) ExecContext(ctx context.Context, dir string, env []string) error {
+	if g.background {
+		return g.execBackground(dir, env)
 	}
-	return err
+	return g.exec(ctx, dir, env)
 }
 
-func (g *gitCmd) exec(dir string) error {
-	return runCmd(g.command, g.args, dir)
+func (g *gitCmd) exec(ctx context.Context, dir string, env []string) error {
+	return execCmd(ctx, g.Command(), g.command, g.args, dir, env)
 }
 
-func (g *gitCmd) execBackground(dir string) error {
-	// if existing process is running, kill it.
-	g.RLock()
-	if g.process != nil {
-		g.haltProcess()
-	}
-	g.RUnlock()
-
-	process, err := runCmdBackground(g.command, g.args, dir)
+// execCmd executes command with args and waits for it to complete.
+// The errors and output are reported as those of the configured
+// command name.
+func execCmd(ctx context.Context, name, command string, args []string, dir string, env []string) error {
+	output := &cmdOutput{}
+	err := runCmd(ctx, command, args, dir, env, output)
 	if err == nil {
-		g.Lock()
-		g.process = process
-		g.Unlock()
-		g.monitorProcess()
+		return nil
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		err = errors.New("timed out")
+	case context.Canceled:
+		err = errors.New("cancelled")
 	}
-	return err
+	if out := output.String(); out != "" {
+		Logger().Printf("Command '%v' output:\n%v\n", name, out)
+		return fmt.Errorf("command '%v' failed: %v\n%v", name, err, out)
+	}
+	return fmt.Errorf("command '%v' failed: %v", name, err)
 }
 
-func (g *gitCmd) monitorProcess() {
-	g.RLock()
-	if g.process == nil {
-		g.RUnlock()
-		return
-	}
-	monitoring := g.monitoring
-	g.RUnlock()
+// execBackground stops the running process of g, if any, and starts
+// a new one, restarted whenever it exits until stopped.
+func (g *gitCmd) execBackground(dir string, env []string) error {
+	g.stop()
 
-	if monitoring {
-		return
+	cmd, err := runCmdBackground(g.command, g.args, dir, env)
+	if err != nil {
+		return fmt.Errorf("command '%v' failed to start: %v", g.Command(), err)
 	}
 
-	type resp struct {
-		state *os.ProcessState
-		err   error
-	}
+	halt, done := make(chan struct{}), make(chan struct{})
+	g.Lock()
+	g.halt, g.done = halt, done
+	g.Unlock()
 
-	respChan := make(chan resp)
+	go g.supervise(cmd, dir, env, halt, done)
+	return nil
+}
 
-	go func() {
-		p, err := g.process.Wait()
-		respChan <- resp{p, err}
-	}()
+// supervise waits for the process of cmd and restarts it when it
+// exits, until halt is closed. The process is then killed and done
+// closed.
+func (g *gitCmd) supervise(cmd gitos.Cmd, dir string, env []string, halt, done chan struct{}) {
+	defer close(done)
 
-	go func() {
-		g.Lock()
-		g.monitoring = true
-		g.Unlock()
+	for {
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
 
 		select {
-		case <-g.haltChan:
-			g.killProcess()
-		case r := <-respChan:
-			if r.err != nil || !r.state.Success() {
-				Logger().Printf("Command '%v' terminated with error", g.Command())
-
-				g.Lock()
-				g.process = nil
-				g.monitoring = false
-				g.Unlock()
-
-				for i := 0; ; i++ {
-					if i >= numRetries {
-						Logger().Printf("Restart failed after 3 attempts for '%v'. Ignoring...\n", g.Command())
-						break
-					}
-					Logger().Printf("Attempting restart %v of %v for '%v'\n", i+1, numRetries, g.Command())
-					if g.restart() == nil {
-						break
-					}
-					time.Sleep(time.Second * 5)
-				}
+		case <-halt:
+			if err := cmd.Kill(); err != nil {
+				Logger().Printf("Could not terminate running command '%v'\n", g.Command())
+			}
+			<-exited
+			Logger().Printf("Command '%v' terminated from within.\n", g.Command())
+			return
+		case err := <-exited:
+			if err != nil {
+				Logger().Printf("Command '%v' terminated with error: %v\n", g.Command(), err)
 			} else {
-				g.Lock()
-				g.process = nil
-				g.monitoring = false
-				g.Unlock()
+				Logger().Printf("Command '%v' terminated.\n", g.Command())
 			}
 		}
-	}()
 
+		cmd = g.restart(dir, env, halt)
+		if cmd == nil {
+			return
+		}
+	}
 }
 
-func (g *gitCmd) killProcess() {
-	g.Lock()
-	if err := g.process.Kill(); err != nil {
-		Logger().Printf("Could not terminate running command '%v'\n", g.command)
-	} else {
-		Logger().Printf("Command '%v' terminated from within.\n", g.command)
+// restart starts the process again after restartDelay, retrying up
+// to numRetries times. It returns nil if it failed or halt is closed.
+func (g *gitCmd) restart(dir string, env []string, halt chan struct{}) gitos.Cmd {
+	for i := 0; i < numRetries; i++ {
+		delay := gos.NewTicker(restartDelay)
+		select {
+		case <-halt:
+			delay.Stop()
+			return nil
+		case <-delay.C():
+			delay.Stop()
+		}
+
+		Logger().Printf("Attempting restart %v of %v for '%v'\n", i+1, numRetries, g.Command())
+		cmd, err := runCmdBackground(g.command, g.args, dir, env)
+		if err == nil {
+			Logger().Printf("Restart successful for '%v'.\n", g.Command())
+			return cmd
+		}
+		Logger().Printf("Restart failed for '%v': %v\n", g.Command(), err)
 	}
-	g.process = nil
-	g.monitoring = false
-	g.Unlock()
+	Logger().Printf("Restart failed after %v attempts for '%v'. Ignoring...\n", numRetries, g.Command())
+	return nil
 }
 
-// haltProcess halts the running process
-func (g *gitCmd) haltProcess() {
-	g.RLock()
-	monitoring := g.monitoring
-	g.RUnlock()
+// stop kills the running background process, if any,
+// and waits for it to terminate.
+func (g *gitCmd) stop() {
+	g.Lock()
+	halt, done := g.halt, g.done
+	g.halt, g.done = nil, nil
+	g.Unlock()
 
-	if monitoring {
-		g.haltChan <- struct{}{}
+	if halt != nil {
+		close(halt)
+		<-done
 	}
 }
 
 // runCmd is a helper function to run commands.
-// It runs command with args from directory at dir.
-// The executed process outputs to os.Stderr
-func runCmd(command string, args []string, dir string) error {
+// It runs command with args from directory at dir, adding
+// env to the environment. The executed process outputs to os.Stderr
+// and, combined, to output. The process and the processes it started
+// are killed when ctx is done, returning ctx.Err().
+func runCmd(ctx context.Context, command string, args []string, dir string, env []string, output io.Writer) error {
 	cmd := gos.Command(command, args...)
-	cmd.Stdout(os.Stderr)
-	cmd.Stderr(os.Stderr)
+	cmd.Stdout(io.MultiWriter(os.Stderr, output))
+	cmd.Stderr(io.MultiWriter(os.Stderr, output))
 	cmd.Dir(dir)
+	cmd.Env(env)
+	cmd.ProcessGroup()
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return cmd.Wait()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if err := cmd.Kill(); err != nil {
+			Logger().Printf("Failed to kill '%v': %v\n", command, err)
+		}
+		<-done
+		return ctx.Err()
+	}
 }
 
 // runCmdBackground is a helper function to run commands in the background.
-// It returns the resulting process and an error that occurs during while
+// It returns the started command and an error that occurs during while
 // starting the process (if any).
-func runCmdBackground(command string, args []string, dir string) (*os.Process, error) {
+func runCmdBackground(command string, args []string, dir string, env []string) (gitos.Cmd, error) {
 	cmd := gos.Command(command, args...)
 	cmd.Dir(dir)
+	cmd.Env(env)
 	cmd.Stdout(os.Stderr)
 	cmd.Stderr(os.Stderr)
-	err := cmd.Start()
-	return cmd.Process(), err
+	cmd.ProcessGroup()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// maxCmdOutput is the number of bytes of output of a failed
+// command included in its error.
+const maxCmdOutput = 4096
+
+// cmdOutput is an io.Writer keeping the last maxCmdOutput bytes
+// written to it.
+type cmdOutput struct {
+	buf       []byte
+	truncated bool
+	sync.Mutex
+}
+
+func (o *cmdOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	o.buf = append(o.buf, p...)
+	if len(o.buf) > maxCmdOutput {
+		o.buf = o.buf[len(o.buf)-maxCmdOutput:]
+		o.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the kept output, trimmed.
+func (o *cmdOutput) String() string {
+	o.Lock()
+	defer o.Unlock()
+	out := string(bytes.TrimSpace(o.buf))
+	if o.truncated {
+		out = "..." + out
+	}
+	return out
 }
 
 // runCmdOutput is a helper function to run commands and return output.
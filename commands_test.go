@@ -0,0 +1,154 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gitos"
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestThenOutput(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the commands are executed by the operating system
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	then := NewThen("sh", "-c", "echo building; echo 'build failed: missing layout' >&2; exit 3")
+	err := execCommand(context.Background(), then, dir, nil)
+	if err == nil {
+		t.Fatal("Expected error of failing command")
+	}
+	for _, s := range []string{"exit status 3", "building", "build failed: missing layout"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected error to contain %q found %q", s, err)
+		}
+	}
+
+	then = NewLongThen("command-not-found-caddy-git")
+	if err := execCommand(context.Background(), then, dir, nil); err == nil || !strings.Contains(err.Error(), "failed to start") {
+		t.Errorf("Expected start error found %v", err)
+	}
+}
+
+func TestThenTimeout(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the commands are executed by the operating system
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := &Repo{Path: dir, ThenTimeout: 100 * time.Millisecond}
+	// the child sleep would keep running without killing the process group
+	repo.Then = []Then{NewThen("sh", "-c", "sleep 10; echo done")}
+
+	start := time.Now()
+	err := repo.execThen()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout error found %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected command to be killed, took %v", elapsed)
+	}
+}
+
+func TestCmdOutput(t *testing.T) {
+	output := &cmdOutput{}
+	output.Write([]byte("short\n"))
+	if s := output.String(); s != "short" {
+		t.Errorf("Expected output %q found %q", "short", s)
+	}
+
+	output.Write([]byte(strings.Repeat("a", maxCmdOutput) + "end\n"))
+	s := output.String()
+	if !strings.HasPrefix(s, "...") || !strings.HasSuffix(s, "end") {
+		t.Errorf("Expected truncated output ending with end found %q", s)
+	}
+	if len(s) > maxCmdOutput+len("...") {
+		t.Errorf("Expected output of at most %v bytes found %v", maxCmdOutput, len(s))
+	}
+}
+
+// waitProcesses waits for n processes of the long running command name
+// to be started.
+func waitProcesses(t *testing.T, name string, n int) []*gittest.Process {
+	for i := 0; i < 100; i++ {
+		if p := gittest.Processes(name); len(p) >= n {
+			return p
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Expected %v processes of %v found %v", n, name, len(gittest.Processes(name)))
+	return nil
+}
+
+func TestLongThenNewCommit(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+	gittest.LongRunning("sidecar-commit")
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Then: []Then{NewLongThen("sidecar-commit")}})
+	repo.MinInterval = 0
+	defer repo.stopThen()
+
+	check(t, repo.Pull())
+	first := waitProcesses(t, "sidecar-commit", 1)[0]
+
+	// no new commit, the process keeps running
+	check(t, repo.Pull())
+	if p := gittest.Processes("sidecar-commit"); len(p) != 1 || first.Exited() {
+		t.Fatalf("Expected the process to keep running without new commit")
+	}
+
+	remote.commit(t, "index.html", "second")
+	check(t, repo.Pull())
+	procs := waitProcesses(t, "sidecar-commit", 2)
+	if !first.Killed() {
+		t.Error("Expected the previous process to be killed on new commit")
+	}
+	if procs[1].Exited() {
+		t.Error("Expected the new process to be running")
+	}
+
+	repo.stopThen()
+	if !procs[1].Killed() {
+		t.Error("Expected the process to be killed when stopped")
+	}
+}
+
+func TestLongThenCrash(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+	gittest.LongRunning("sidecar-crash")
+
+	then := NewLongThen("sidecar-crash").(*gitCmd)
+	defer then.stop()
+	check(t, execCommand(context.Background(), then, "", nil))
+
+	first := waitProcesses(t, "sidecar-crash", 1)[0]
+	first.Exit(errors.New("exit status 1"))
+
+	procs := waitProcesses(t, "sidecar-crash", 2)
+	if first.Killed() {
+		t.Error("Expected the crashed process not to be killed")
+	}
+	if procs[1].Exited() {
+		t.Error("Expected the restarted process to be running")
+	}
+}
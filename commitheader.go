@@ -0,0 +1,64 @@
+package git
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// CommitHeader is the response header carrying the commit
+// of the repository serving the requested file.
+const CommitHeader = "X-Git-Commit"
+
+// CommitHandler is middleware setting the CommitHeader of the responses
+// to the commit deployed by the repository the requested file is
+// served from, e.g. for a CDN to invalidate its cache after a deploy.
+type CommitHandler struct {
+	Root  string // Root of the site
+	Repos []*Repo
+	Next  httpserver.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (h CommitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if repo := h.repo(r.URL.Path); repo != nil {
+		if commit := repo.Status().LastCommit; commit != "" {
+			w.Header().Set(CommitHeader, commit)
+		}
+	}
+	return h.Next.ServeHTTP(w, r)
+}
+
+// repo returns the repository with the deepest directory containing
+// the file served for the request path, nil if there is none.
+func (h CommitHandler) repo(reqPath string) *Repo {
+	file := filepath.Join(h.Root, filepath.FromSlash(path.Clean("/"+reqPath)))
+
+	var match *Repo
+	var matchDir string
+	for _, repo := range h.Repos {
+		dir := repo.servedDir()
+		if !inDir(dir, file) || len(dir) <= len(matchDir) {
+			continue
+		}
+		match, matchDir = repo, dir
+	}
+	return match
+}
+
+// servedDir returns the directory the files of r are served from.
+func (r *Repo) servedDir() string {
+	if r.CheckoutDir != "" {
+		return filepath.Clean(r.CheckoutDir)
+	}
+	return filepath.Clean(r.Path)
+}
+
+// inDir checks if file is dir or is in dir.
+func inDir(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,67 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestCommitHandler(t *testing.T) {
+	root := filepath.FromSlash("/srv/site")
+	pulled := func(path, commit string) *Repo {
+		repo := createRepo(&Repo{Path: path})
+		repo.lastCommit = commit
+		repo.setStatus(nil)
+		return repo
+	}
+	site := pulled(root, "1111111")
+	docs := pulled(filepath.Join(root, "docs"), "2222222")
+	deployed := pulled(filepath.FromSlash("/var/lib/git/app"), "3333333")
+	deployed.CheckoutDir = filepath.Join(root, "app")
+	blog := createRepo(&Repo{Path: filepath.Join(root, "blog")})
+
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusOK, nil
+	})
+	handler := CommitHandler{Root: root, Repos: []*Repo{site, docs, deployed, blog}, Next: next}
+
+	tests := []struct {
+		path   string
+		commit string
+	}{
+		{"/", "1111111"},
+		{"/index.html", "1111111"},
+		{"/docs/guide/index.html", "2222222"},
+		{"/docsearch.js", "1111111"},
+		{"/app/main.js", "3333333"},
+		{"/docs/../app/main.js", "3333333"},
+		// not pulled yet
+		{"/blog/index.html", ""},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		check(t, err)
+		rec := httptest.NewRecorder()
+		code, err := handler.ServeHTTP(rec, req)
+		check(t, err)
+		if code != http.StatusOK {
+			t.Errorf("Test %v: expected request passed to the next handler found %v", i, code)
+		}
+		if commit := rec.Header().Get(CommitHeader); commit != test.commit {
+			t.Errorf("Test %v: expected commit %q found %q", i, test.commit, commit)
+		}
+	}
+
+	// the files outside of the repos have no commit
+	handler.Repos = []*Repo{docs}
+	req, err := http.NewRequest("GET", "/index.html", nil)
+	check(t, err)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if commit := rec.Header().Get(CommitHeader); commit != "" {
+		t.Errorf("Expected no commit found %q", commit)
+	}
+}
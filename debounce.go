@@ -0,0 +1,50 @@
+package git
+
+import (
+	"time"
+)
+
+// debounceThen schedules r.Then to execute once no pull changed r for
+// r.ThenDebounce, coalescing the pulls within the window into a single
+// execution. from is the commit before the pull. r must be locked.
+func (r *Repo) debounceThen(from string) {
+	r.debounceAt = time.Now().Add(r.ThenDebounce)
+	if r.debounce != nil {
+		r.debounce.Reset(r.ThenDebounce)
+		return
+	}
+	// the files changed since the first coalesced pull are passed
+	r.debounceFrom = from
+	r.debounce = time.AfterFunc(r.ThenDebounce, r.execDebouncedThen)
+	Logger().Printf("Commands of %v delayed by %v.\n", r.label(), r.ThenDebounce)
+}
+
+// execDebouncedThen executes r.Then scheduled by debounceThen. The
+// failures are recorded like failed pulls.
+func (r *Repo) execDebouncedThen() {
+	r.Lock()
+	defer r.Unlock()
+
+	// stopped, or delayed again by a pull while waiting for the lock
+	if r.debounce == nil || time.Now().Before(r.debounceAt) {
+		return
+	}
+	r.debounce = nil
+
+	r.listChanged(r.debounceFrom)
+	if err := r.execThen(); err != nil {
+		Logger().Println(err)
+		r.setStatus(err)
+		r.execOnError(err)
+	}
+}
+
+// stopDebounce cancels the execution of r.Then scheduled by debounceThen.
+func (r *Repo) stopDebounce() {
+	r.Lock()
+	defer r.Unlock()
+	if r.debounce != nil {
+		r.debounce.Stop()
+		r.debounce = nil
+	}
+}
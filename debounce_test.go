@@ -0,0 +1,63 @@
+package git
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestThenDebounce(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	then := &countThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.ThenDebounce = 100 * time.Millisecond
+	repo.Then = []Then{then}
+	defer repo.stopDebounce()
+
+	// executions returns the number of executions of then
+	// once the delayed execution is due
+	executions := func() int {
+		time.Sleep(3 * repo.ThenDebounce)
+		repo.Lock()
+		defer repo.Unlock()
+		return then.n
+	}
+
+	// three pulls in a row
+	check(t, repo.Pull())
+	for _, content := range []string{"second", "third"} {
+		remote.commit(t, "index.html", content)
+		check(t, repo.Pull())
+	}
+	repo.Lock()
+	if then.n != 0 {
+		t.Errorf("Expected then delayed, found %v executions", then.n)
+	}
+	repo.Unlock()
+	if n := executions(); n != 1 {
+		t.Errorf("Expected then executed once after the pulls, found %v executions", n)
+	}
+
+	// pulls without changes don't execute then
+	check(t, repo.Pull())
+	if n := executions(); n != 1 {
+		t.Errorf("Expected then not executed without changes, found %v executions", n)
+	}
+
+	remote.commit(t, "index.html", "fourth")
+	check(t, repo.Pull())
+	if n := executions(); n != 2 {
+		t.Errorf("Expected then executed after the next pull, found %v executions", n)
+	}
+}
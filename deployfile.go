@@ -0,0 +1,87 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// deployRef returns the ref named by r.DeployFile in the latest
+// fetched commit of the branch: a commit hash or a tag name.
+func (r *Repo) deployRef(gr *git.Repository) (string, error) {
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return "", r.branchNotFound(r.Branch)
+	}
+	if err != nil {
+		return "", err
+	}
+	commit, err := gr.CommitObject(ref.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	file, err := commit.File(r.DeployFile)
+	if err == object.ErrFileNotFound {
+		return "", fmt.Errorf("deploy file %v not found in branch %v", r.DeployFile, r.Branch)
+	}
+	if err != nil {
+		return "", err
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return "", err
+	}
+
+	// the first line names the ref
+	name := strings.TrimSpace(content)
+	if i := strings.IndexAny(name, "\r\n"); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	if name == "" {
+		return "", fmt.Errorf("deploy file %v of branch %v is empty", r.DeployFile, r.Branch)
+	}
+	return name, nil
+}
+
+// checkoutDeployFile checks out the commit or tag named by r.DeployFile
+// in the branch, leaving the worktree detached at it.
+func (r *Repo) checkoutDeployFile(gr *git.Repository) error {
+	name, err := r.deployRef(gr)
+	if err != nil {
+		return err
+	}
+
+	var hash plumbing.Hash
+	if isHash(name) {
+		hash = plumbing.NewHash(name)
+		if _, err := gr.CommitObject(hash); err == plumbing.ErrObjectNotFound {
+			return fmt.Errorf("commit %v named by %v not found in %v", name, r.DeployFile, r.URL)
+		} else if err != nil {
+			return err
+		}
+	} else {
+		ref, err := gr.Tag(name)
+		if err == git.ErrTagNotFound {
+			return fmt.Errorf("tag %v named by %v not found in %v", name, r.DeployFile, r.URL)
+		}
+		if err != nil {
+			return err
+		}
+		if hash, err = tagCommit(gr, ref); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkoutCommit(gr, hash.String()); err != nil {
+		return err
+	}
+	if name != r.deployFileRef {
+		Logger().Printf("Checked out %v named by %v.\n", name, r.DeployFile)
+	}
+	r.deployFileRef = name
+	return nil
+}
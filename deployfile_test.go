@@ -0,0 +1,62 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestDeployFile(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	first := remote.commit(t, "index.html", "first")
+	second := remote.commit(t, "index.html", "second")
+	remote.annotatedTag(t, "v2.0.0", second)
+	remote.commit(t, "index.html", "master")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.DeployFile = ".deploy"
+
+	tests := []struct {
+		ref     string
+		commit  string
+		content string
+	}{
+		{first + "\n", first, "first"},
+		{"v2.0.0\n", second, "second"},
+	}
+	for i, test := range tests {
+		remote.commit(t, ".deploy", test.ref)
+		check(t, repo.Pull())
+
+		if repo.lastCommit != test.commit {
+			t.Errorf("Test %v: expected commit %v found %v", i, test.commit, repo.lastCommit)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		if string(data) != test.content {
+			t.Errorf("Test %v: expected %q checked out found %q", i, test.content, data)
+		}
+	}
+
+	remote.commit(t, ".deploy", "v3.0.0")
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "tag v3.0.0 named by .deploy not found") {
+		t.Errorf("Expected missing tag error found %v", err)
+	}
+
+	remote.remove(t, ".deploy")
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "deploy file .deploy not found") {
+		t.Errorf("Expected missing deploy file error found %v", err)
+	}
+}
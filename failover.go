@@ -0,0 +1,58 @@
+package git
+
+import (
+	"context"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// pullURL returns the url r is pulled from,
+// FallbackURL while falling back to it.
+func (r *Repo) pullURL() RepoURL {
+	if r.fallback {
+		return r.FallbackURL
+	}
+	return r.URL
+}
+
+// pullFallback attempts a pull from r.FallbackURL once the pulls from
+// r.URL failed. The remote of an existing clone points to the fallback
+// for the duration of the pull only, the next pulls try r.URL first.
+// r must be locked.
+func (r *Repo) pullFallback(ctx context.Context) error {
+	Logger().Printf("Pulling %v from %v instead.\n", r.label(), r.FallbackURL)
+	r.fallback = true
+	defer func() { r.fallback = false }()
+
+	if r.pulled {
+		if err := r.setRemoteURL(r.FallbackURL.Val()); err != nil {
+			return err
+		}
+	}
+	err := r.pullContext(ctx)
+	if !r.pulled {
+		return err
+	}
+	if restoreErr := r.setRemoteURL(r.URL.Val()); err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// setRemoteURL sets the url of the remote of the local repository.
+func (r *Repo) setRemoteURL(url string) error {
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return err
+	}
+	cfg, err := gr.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := cfg.Remotes[r.remoteName()]
+	if !ok {
+		return git.ErrRemoteNotFound
+	}
+	remote.URLs = []string{url}
+	return gr.Storer.SetConfig(cfg)
+}
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
 // GenericHook is generic webhook.
@@ -15,6 +14,11 @@ type gPush struct {
 	Ref string `json:"ref"`
 }
 
+// RequiresSecret satisfies hookHandler.
+func (g GenericHook) RequiresSecret() bool {
+	return false
+}
+
 // DoesHandle satisfies hookHandler.
 func (g GenericHook) DoesHandle(h http.Header) bool {
 	return true
@@ -31,12 +35,7 @@ func (g GenericHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo)
 		return http.StatusRequestTimeout, errors.New("could not read body from request")
 	}
 
-	err = g.handlePush(body, repo)
-	if err != nil {
-		return http.StatusBadRequest, err
-	}
-
-	return http.StatusOK, nil
+	return hookStatus(g.handlePush(body, repo))
 }
 
 func (g GenericHook) handlePush(body []byte, repo *Repo) error {
@@ -47,18 +46,6 @@ func (g GenericHook) handlePush(body []byte, repo *Repo) error {
 		return err
 	}
 
-	// extract the branch being pushed from the ref string
-	// and if it matches with our locally tracked one, pull.
-	refSlice := strings.Split(push.Ref, "/")
-	if len(refSlice) != 3 {
-		return errors.New("the push request contained an invalid reference string")
-	}
-
-	branch := refSlice[2]
-	if branch == repo.Branch {
-		Logger().Print("Received pull notification for the tracking branch, updating...\n")
-		repo.Pull()
-	}
-
-	return nil
+	// pull if the pushed branch or tag is one pulled by repo
+	return pullPushedRef(g, repo, push.Ref)
 }
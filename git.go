@@ -1,24 +1,36 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/akhenakh/caddy-puregit/gitos"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 const (
-	// Number of retries if git pull fails
+	// Default number of retries if git pull fails
 	numRetries = 3
 
 	// variable for latest tag
 	latestTag = "{latest}"
+
+	// default recursion depth of submodules
+	defaultSubmoduleDepth = git.DefaultSubmoduleRecursionDepth
+
+	// maximum backoff between two attempts of a pull,
+	// unless the configured backoff is longer
+	maxRetryBackoff = 10 * time.Minute
 )
 
 // Git represent multiple repositories.
@@ -48,74 +60,464 @@ func (r RepoURL) String() string {
 	return u.String()
 }
 
+// public returns the url without credentials, for the status and health
+// pages. Only the user of ssh urls is kept, the user of other urls may
+// be a token.
+func (r RepoURL) public() string {
+	u, err := url.Parse(string(r))
+	if err != nil || r.isSSH() {
+		return r.String()
+	}
+	u.User = nil
+	return u.String()
+}
+
 // Val returns git friendly Val that can be
-// passed to git clone.
+// passed to git clone. ssh urls with a path separated by a colon
+// e.g. ssh://git@github.com:user/repo are converted to the scp-like
+// syntax git@github.com:user/repo, other urls e.g. with a port
+// ssh://git@github.com:2222/user/repo are kept as is.
 func (r RepoURL) Val() string {
-	if strings.HasPrefix(string(r), "ssh://") {
-		return strings.TrimPrefix(string(r), "ssh://")
+	if userHost, path, ok := r.scp(); ok {
+		return userHost + ":" + path
 	}
 	return string(r)
 }
 
+// scp splits ssh urls with a path separated by a colon into the
+// user and host, and the path. ok is false for other urls.
+func (r RepoURL) scp() (userHost, path string, ok bool) {
+	s := strings.TrimPrefix(string(r), "ssh://")
+	if s == string(r) {
+		return "", "", false
+	}
+	authority := s
+	if i := strings.Index(s, "/"); i >= 0 {
+		authority = s[:i]
+	}
+	i := strings.LastIndex(authority, ":")
+	if i < 0 || i < strings.LastIndex(authority, "@") {
+		return "", "", false
+	}
+	if port := authority[i+1:]; port != "" && strings.Trim(port, "0123456789") == "" {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
 // Repo is the structure that holds required information
 // of a git repository.
 type Repo struct {
-	URL        RepoURL       // Repository URL
-	Path       string        // Directory to pull to
-	Host       string        // Git domain host e.g. github.com
-	Branch     string        // Git branch
-	Token      string        // Authentication token
-	Interval   time.Duration // Interval between pulls
-	Then       []Then        // Commands to execute after successful git pull
-	pulled     bool          // true if there was a successful pull
-	lastPull   time.Time     // time of the last successful pull
-	lastCommit string        // hash for the most recent commit
-	latestTag  string        // latest tag name
-	Hook       HookConfig    // Webhook configuration
+	URL                      RepoURL                           // Repository URL
+	Name                     string                            // Name identifying the repository on the pull endpoint
+	Path                     string                            // Directory to pull to
+	BaseDir                  string                            // Directory of the relative paths, the site root by default
+	Host                     string                            // Git domain host e.g. github.com
+	Branch                   string                            // Git branch
+	Remote                   string                            // Name of the remote repository, origin by default
+	FallbackURL              RepoURL                           // Remote pulled from when the pulls from URL fail
+	FallbackToken            string                            // Authentication token of FallbackURL
+	Commit                   string                            // Commit hash to pin the worktree to
+	Tag                      string                            // Tag to pin the worktree to
+	TagFilter                string                            // Glob, or regexp between slashes, of the tags considered for the latest tag
+	DeployFile               string                            // File of the branch naming the commit or tag to check out
+	RefSpec                  string                            // Fetch refspec of the ref to check out instead of the branch
+	Branches                 []*BranchSpec                     // Additional branches checked out into subdirectories
+	Token                    string                            // Authentication token
+	TokenFile                string                            // File to read the token from at each pull
+	User                     string                            // Authentication user
+	Password                 string                            // Authentication password
+	KeyPath                  string                            // Path to the ssh private key
+	KeyPassphrase            string                            // Passphrase of the ssh private key
+	KnownHosts               string                            // Path to the known_hosts file verifying the ssh host keys
+	InsecureSkipHostKeyCheck bool                              // Skip the verification of the ssh host keys
+	ProxyURL                 string                            // Proxy to reach the repository through
+	UserAgent                string                            // User-Agent sent to the http git server
+	Interval                 time.Duration                     // Interval between pulls
+	Jitter                   bool                              // Delay the first scheduled pull by a random fraction of Interval
+	MinInterval              time.Duration                     // Minimum interval between two pulls, 0 disables
+	Depth                    int                               // Number of commits to clone, 0 for full clone
+	Filter                   string                            // Partial clone filter e.g. blob:none, not supported by go-git
+	Unshallow                bool                              // Fetch the whole history after the first shallow clone
+	MaxSize                  int64                             // Maximum size in bytes of the clone, history included, 0 disables
+	RemoveOversized          bool                              // Remove the clone exceeding MaxSize
+	SubmoduleDepth           git.SubmoduleRescursivity         // Submodules recursion depth, 0 disables submodules
+	Retries                  int                               // Number of pull attempts
+	RetryBackoff             time.Duration                     // Delay before the first retry, doubled after each retry
+	RetryDeadline            time.Duration                     // Maximum total duration of the pull attempts, 0 for none
+	Timeout                  time.Duration                     // Maximum duration of a pull attempt, 0 disables
+	MaxConcurrentClones      int                               // Limit of clones and pulls of all repos running at once, 0 if not set
+	BestEffort               bool                              // Don't fail startup if the initial pull fails
+	SkipStartupPull          bool                              // Don't pull at startup, wait for the first interval or webhook
+	Clean                    bool                              // Discard local changes before pulling
+	AllowRewind              bool                              // Allow checking out a head not descending from the deployed commit
+	FetchOnly                bool                              // Only fetch and record the remote head, leaving the worktree untouched
+	Mirror                   bool                              // Keep a bare mirror of all the branches and tags, without checkout
+	Push                     bool                              // Commit the local changes and push them upstream at each interval
+	PushMessage              string                            // Message of the commits of the local changes
+	DeployMarker             string                            // File written with the deployed commit, relative to Path
+	CheckoutDir              string                            // Directory the files are atomically deployed to, outside of Path
+	Sparse                   []string                          // Directories checked out, the rest of the worktree is left out
+	LogPath                  string                            // File the plugin logs are appended to, instead of stderr
+	LogLevel                 LogLevel                          // Verbosity of the logs of the repo
+	LogFormat                string                            // Format of the plugin logs, text or json
+	VerifyKey                string                            // Armored PGP public key file the new commits must be signed with
+	Then                     []Then                            // Commands to execute after successful git pull
+	ThenOnce                 []Then                            // Commands to execute once after the initial clone, before Then
+	ThenEnv                  []string                          // Environment variables added to the Then commands, as KEY=VALUE
+	ThenTimeout              time.Duration                     // Maximum duration of each Then command not running in background
+	ThenDebounce             time.Duration                     // Delay of the Then commands coalescing the pulls in a row, 0 disables
+	ThenContinue             bool                              // Execute the remaining Then commands after one fails
+	ThenShell                string                            // Shell executing the then_script commands, sh by default
+	Before                   []Then                            // Commands executed before a pull likely to change the files
+	BeforeAlways             bool                              // Execute the Before commands before every pull
+	OnError                  []Then                            // Commands executed after a failed pull
+	OnPull                   func(oldCommit, newCommit string) // Called after a successful pull changing the commit
+	pulled                   bool                              // true if there was a successful pull
+	cloned                   bool                              // true if the running pull performed the initial clone
+	lastPull                 time.Time                         // time of the last successful pull
+	lastAttempt              time.Time                         // time of the last pull, successful or not
+	lastCommit               string                            // hash for the most recent commit
+	deployedCommit           string                            // hash of the commit deployed to CheckoutDir
+	unshallowed              bool                              // whether the whole history is fetched
+	fallback                 bool                              // whether the pull falls back to FallbackURL
+	latestTag                string                            // latest tag name
+	deployFileRef            string                            // commit or tag named by DeployFile last checked out
+	lastError                error                             // error of the last pull, nil if it succeeded
+	lastErrorTime            time.Time                         // time of the last failed pull
+	changed                  []string                          // files changed by the last pull, nil if unknown
+	debounce                 *time.Timer                       // executes the Then commands delayed by ThenDebounce
+	debounceAt               time.Time                         // time the delayed Then commands are due
+	debounceFrom             string                            // commit before the first pull of the delayed Then commands
+	status                   RepoStatus                        // state reported by the status endpoint
+	statusMu                 sync.Mutex                        // guards status
+	ctx                      context.Context                   // cancelled to abort the running pulls
+	cancel                   context.CancelFunc                // cancels ctx
+	ctxMu                    sync.Mutex                        // guards ctx and cancel
+	pulling                  int32                             // number of running pulls, accessed atomically
+	hookQueued               int32                             // 1 if a pull of an asynchronous webhook is waiting to run, accessed atomically
+	hookMu                   sync.Mutex                        // serializes the pulls of asynchronous webhooks
+	hookWraps                []hookPull                        // wrappers of the queued pull of asynchronous webhooks
+	hookWrapsMu              sync.Mutex                        // protects hookWraps
+	deliveries               map[string]time.Time              // webhook delivery ids received within deliveryWindow
+	deliveriesMu             sync.Mutex                        // guards deliveries
+	Hook                     HookConfig                        // Webhook configuration
+	StatusPath               string                            // Path of the JSON status endpoint
+	HealthPath               string                            // Path of the health endpoint
+	PullPath                 string                            // Path of the endpoint pulling on demand
+	PullToken                string                            // Bearer token required by the pull endpoint
+	SetCommitHeader          bool                              // Set the commit header of the responses serving the files of the repo
+	Metrics                  bool                              // Record prometheus metrics of pulls
+	MetricsPath              string                            // Path serving the prometheus metrics
 	sync.Mutex
 }
 
 // Pull attempts a git pull.
-// It retries at most numRetries times if error occurs
+// It attempts at most r.Retries times if error occurs
 func (r *Repo) Pull() error {
+	return r.pullWith(nil)
+}
+
+// pullWith attempts a git pull like Pull, wrapped by wrap
+// if not nil.
+func (r *Repo) pullWith(wrap hookPull) error {
+	atomic.AddInt32(&r.pulling, 1)
+	defer atomic.AddInt32(&r.pulling, -1)
+	return r.doPull(wrap)
+}
+
+// TryPull attempts a git pull like Pull unless a pull of r is
+// already running. It returns false if the pull was skipped.
+func (r *Repo) TryPull() (bool, error) {
+	if !atomic.CompareAndSwapInt32(&r.pulling, 0, 1) {
+		return false, nil
+	}
+	defer atomic.AddInt32(&r.pulling, -1)
+	return true, r.doPull(nil)
+}
+
+// doPull attempts a git pull and calls r.OnPull if the commit changed.
+// The pull is wrapped by wrap if not nil, which runs with r locked.
+func (r *Repo) doPull(wrap hookPull) error {
 	r.Lock()
-	defer r.Unlock()
+	var oldCommit, newCommit string
+	pull := func() (err error) {
+		oldCommit, newCommit, err = r.update()
+		return err
+	}
+	var err error
+	if wrap != nil {
+		err = wrap(pull)
+	} else {
+		err = pull()
+	}
+	r.setStatus(err)
+	if err != nil {
+		r.execOnError(err)
+	}
+	r.Unlock()
 
-	// prevent a pull if the last one was less than 5 seconds ago
-	if gos.TimeSince(r.lastPull) < 5*time.Second {
-		return nil
+	// the callback runs unlocked as it may call back into the repo
+	if oldCommit != newCommit && r.OnPull != nil {
+		r.OnPull(oldCommit, newCommit)
 	}
+	return err
+}
 
+// update attempts a git pull and executes r.Then if there are
+// new changes. It returns the most recent commit hash before and
+// after the pull. r must be locked.
+func (r *Repo) update() (oldCommit, newCommit string, err error) {
 	// keep last commit hash for comparison later
 	lastCommit := r.lastCommit
+	r.changed = nil
+	r.cloned = false
 
-	var err error
-	// Attempt to pull at most numRetries times
-	for i := 0; i < numRetries; i++ {
-		if err = r.pull(); err == nil {
+	// prevent a pull if the last one was less than r.MinInterval ago,
+	// failed pulls included so they are not retried in a loop
+	if gos.TimeSince(r.lastAttempt) < r.MinInterval {
+		return lastCommit, lastCommit, nil
+	}
+	r.lastAttempt = time.Now()
+
+	start := time.Now()
+	defer func() { r.observePull(start, err) }()
+
+	// the attempts are aborted together by Cancel
+	ctx := r.context()
+
+	if err = r.execBefore(ctx); err != nil {
+		return lastCommit, lastCommit, err
+	}
+
+	// a single attempt is always made
+	attempts := r.Retries
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	// Attempt to pull at most attempts times
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			// back off exponentially before retrying,
+			// unless the attempt would start past the deadline
+			backoff := retryBackoff(r.RetryBackoff, i)
+			if r.RetryDeadline > 0 && gos.TimeSince(start)+backoff >= r.RetryDeadline {
+				r.logEvent(LogNormal, "", "", nil, "Retries of %v stopped after %v attempts, deadline of %v exceeded.\n", r.label(), i, r.RetryDeadline)
+				break
+			}
+			gos.Sleep(backoff)
+		}
+		if err = r.pullContext(ctx); err == nil {
+			break
+		}
+		r.logEvent(LogQuiet, "error", "", err, "%v\n", err)
+
+		// bad credentials and refused rewinds are reported right away
+		if isAuthError(err) || isRewindError(err) {
 			break
 		}
-		Logger().Println(err)
+	}
+
+	// the primary remote is unavailable, try the fallback once
+	if err != nil && r.FallbackURL != "" && ctx.Err() == nil && !isRewindError(err) {
+		if fallbackErr := r.pullFallback(ctx); fallbackErr != nil {
+			r.logEvent(LogQuiet, "error", "", fallbackErr, "%v\n", fallbackErr)
+		} else {
+			err = nil
+		}
 	}
 
 	if err != nil {
-		return err
+		return lastCommit, lastCommit, err
+	}
+
+	// an oversized clone is neither deployed nor reported
+	if err := r.checkSize(); err != nil {
+		return lastCommit, lastCommit, err
+	}
+
+	// nothing is checked out in fetch only and mirror modes,
+	// the new commits are only reported
+	if r.FetchOnly || r.Mirror {
+		if r.lastCommit != lastCommit {
+			r.logEvent(LogQuiet, "commit", r.lastCommit, nil, "%v has new commit %v.\n", r.label(), r.lastCommit)
+		}
+		return lastCommit, r.lastCommit, nil
+	}
+
+	// unverified commits are not deployed
+	if r.VerifyKey != "" && r.lastCommit != lastCommit {
+		if err := r.verifyCommit(); err != nil {
+			r.rollback(lastCommit)
+			return lastCommit, r.lastCommit, err
+		}
+	}
+
+	branchesChanged, err := r.checkoutBranches()
+	if err != nil {
+		return lastCommit, r.lastCommit, err
+	}
+
+	if err := r.deployCheckout(); err != nil {
+		return lastCommit, r.lastCommit, err
 	}
 
 	// check if there are new changes,
 	// then execute post pull command
-	if r.lastCommit == lastCommit {
-		Logger().Println("No new changes.")
-		return nil
+	if r.lastCommit == lastCommit && !branchesChanged {
+		r.logEvent(LogNormal, "unchanged", r.lastCommit, nil, "No new changes.\n")
+		return lastCommit, lastCommit, nil
+	}
+	r.writeDeployMarker()
+
+	// the setup commands of a new clone precede the other commands
+	var onceErr error
+	if r.cloned {
+		onceErr = r.execCommands(r.ThenOnce)
+		if onceErr != nil && !r.ThenContinue {
+			return lastCommit, r.lastCommit, onceErr
+		}
+	}
+
+	// the commands run once the pulls in a row settle
+	if r.ThenDebounce > 0 && len(r.Then) > 0 {
+		r.debounceThen(lastCommit)
+		return lastCommit, r.lastCommit, onceErr
+	}
+
+	r.listChanged(lastCommit)
+	return lastCommit, r.lastCommit, mergeErrors(onceErr, r.execThen())
+}
+
+// retryBackoff returns the backoff before the retry n of a pull:
+// base doubled after each retry, capped to maxRetryBackoff.
+func retryBackoff(base time.Duration, n int) time.Duration {
+	limit := maxRetryBackoff
+	if base > limit {
+		limit = base
+	}
+	backoff := base
+	for i := 1; i < n && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
+// listChanged records the files changed since the commit from,
+// passed to the then commands. They are unknown after the first clone.
+// r must be locked.
+func (r *Repo) listChanged(from string) {
+	r.changed = nil
+	if len(r.Then) == 0 || from == "" || from == r.lastCommit {
+		return
+	}
+	var err error
+	if r.changed, err = r.changedFiles(from, r.lastCommit); err != nil {
+		Logger().Printf("Cannot list the files changed by %v: %v\n", r.lastCommit, err)
+	}
+}
+
+// pullContext performs a pull attempt aborted after r.Timeout
+// or when ctx is done. The attempt waits for the pulls exceeding
+// the limit set with SetMaxConcurrentClones.
+func (r *Repo) pullContext(ctx context.Context) error {
+	// wait for the turn of r, not counted in r.Timeout
+	release, err := acquirePullSlot(ctx)
+	if err != nil {
+		return fmt.Errorf("pulling %v cancelled", r.URL)
+	}
+	defer release()
+
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	// r was cancelled, don't start a new pull
+	err = ctx.Err()
+	if err == nil {
+		err = r.lockedPull(ctx)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("pulling %v timed out after %v", r.URL, r.Timeout)
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		return fmt.Errorf("pulling %v cancelled", r.URL)
+	}
+	return err
+}
+
+// lockPath returns the lock file of r, next to its path
+// for the lock to be shared by the instances pulling it.
+func (r *Repo) lockPath() string {
+	dir, base := filepath.Split(filepath.Clean(r.Path))
+	return filepath.Join(dir, "."+base+".lock")
+}
+
+// lockedPull pulls r while holding the lock of its path, failing
+// if another process is pulling it.
+func (r *Repo) lockedPull(ctx context.Context) error {
+	lock := r.lockPath()
+	if err := gos.MkdirAll(filepath.Dir(lock), os.FileMode(0755)); err != nil {
+		return err
+	}
+	unlock, err := gos.LockFile(lock)
+	if err == gitos.ErrLocked {
+		return fmt.Errorf("%v is locked by another process pulling it, remove %v if there is none", r.Path, lock)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot lock %v: %v", r.Path, err)
+	}
+	defer unlock()
+	return r.pull(ctx)
+}
+
+// context returns the context of the running pulls of r,
+// replaced once cancelled.
+func (r *Repo) context() context.Context {
+	r.ctxMu.Lock()
+	defer r.ctxMu.Unlock()
+	if r.ctx == nil {
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+	}
+	return r.ctx
+}
+
+// Cancel aborts the running pull of r, if any, and the running
+// then commands. The following pulls run normally.
+func (r *Repo) Cancel() {
+	r.ctxMu.Lock()
+	defer r.ctxMu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.ctx, r.cancel = nil, nil
 	}
-	return r.execThen()
 }
 
 // pull performs git pull, or git clone if repository does not exist.
-func (r *Repo) pull() error {
+func (r *Repo) pull(ctx context.Context) error {
+	if r.Mirror {
+		return r.mirror(ctx)
+	}
+	if r.FetchOnly {
+		return r.fetchRemote(ctx)
+	}
+	if len(r.Sparse) > 0 {
+		return r.sparsePull(ctx)
+	}
+
 	// if not pulled, perform clone
 	if !r.pulled {
-		return r.clone()
+		err := r.clone(ctx)
+		if isMissingRef(err) {
+			return r.branchNotFound(r.Branch)
+		}
+		return err
 	}
 
 	gr, err := git.PlainOpen(r.Path)
@@ -123,94 +525,475 @@ func (r *Repo) pull() error {
 		return err
 	}
 
+	// the first clone is shallow, the history is fetched by the next pull
+	if r.Unshallow && !r.unshallowed {
+		recloned, err := r.unshallow(ctx, gr)
+		if err != nil || recloned {
+			return err
+		}
+	}
+
+	// pinned commits and tags are fetched then checked out
+	if r.detached() {
+		if err := r.fetch(ctx, gr); err != nil {
+			return err
+		}
+		if err := r.checkoutTarget(gr); err != nil {
+			return err
+		}
+		return r.pulledHead(ctx, gr)
+	}
+
 	w, err := gr.Worktree()
 	if err != nil {
 		return err
 	}
 
-	var auth *http.BasicAuth
-	if r.Token != "" {
-		auth = &http.BasicAuth{
-			Username: "minigit", // anything except an empty string
-			Password: r.Token,
-		}
+	// the branch may have changed since the clone
+	if err := r.switchBranch(ctx, gr, w); err != nil {
+		return err
 	}
-	err = w.Pull(&git.PullOptions{
-		Auth:          auth,
-		RemoteName:    "origin",
-		ReferenceName: plumbing.ReferenceName("refs/heads/" + r.Branch),
-	})
-	if err != git.NoErrAlreadyUpToDate {
+
+	if r.Clean {
+		return r.resetHard(ctx, gr, w)
+	}
+
+	opts, err := r.pullOptions()
+	if err != nil {
 		return err
 	}
-	ref, err := gr.Head()
+	r.logEvent(LogVerbose, "pull", "", nil, "Pulling branch %v of %v into %v.\n", r.Branch, r.label(), r.Path)
+	err = w.PullContext(ctx, opts)
+	if isMissingRef(err) {
+		return r.branchNotFound(r.Branch)
+	}
+	if err == git.ErrNonFastForwardUpdate {
+		// the remote branch was rewound e.g. by a force push
+		return r.pullRewind(ctx, gr, w)
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		if r.depth() > 0 && ctx.Err() == nil && isShallowError(err) {
+			// go-git is not always able to pull into a shallow clone,
+			// start over with a fresh clone instead.
+			Logger().Printf("Pulling shallow clone of %v failed: %v. Cloning again.\n", r.label(), err)
+			return r.reclone(ctx)
+		}
+		return err
+	}
+	return r.pulledHead(ctx, gr)
+}
+
+// fetchRemote fetches the remote repository and records the head of the
+// remote branch as the most recent commit, leaving the worktree untouched.
+// The repository is cloned without checkout if it does not exist.
+func (r *Repo) fetchRemote(ctx context.Context) error {
+	gr, err := r.fetchOrClone(ctx)
 	if err != nil {
 		return err
 	}
-	commit, err := gr.CommitObject(ref.Hash())
+
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return r.branchNotFound(r.Branch)
+	}
 	if err != nil {
 		return err
 	}
 
 	r.pulled = true
 	r.lastPull = time.Now()
-	Logger().Printf("%v pulled.\n", r.URL)
-	r.lastCommit = commit.String()
+	r.lastCommit = ref.Hash().String()
+	r.logEvent(LogNormal, "fetched", r.lastCommit, nil, "%v fetched.\n", r.label())
 
 	return nil
 }
 
-// clone performs git clone.
-func (r *Repo) clone() error {
-	var auth *http.BasicAuth
+// fetchOrClone fetches the remote repository into r.Path,
+// or clones it without checkout if it does not exist.
+func (r *Repo) fetchOrClone(ctx context.Context) (*git.Repository, error) {
+	gr, err := git.PlainOpen(r.Path)
+	switch err {
+	case nil:
+		if err := r.fetch(ctx, gr); err != nil {
+			return nil, err
+		}
+		return gr, nil
+	case git.ErrRepositoryNotExists:
+		opts, err := r.cloneOptions()
+		if err != nil {
+			return nil, err
+		}
+		opts.NoCheckout = true
+		gr, err := git.PlainCloneContext(ctx, r.Path, false, opts)
+		r.cloned = err == nil && r.lastCommit == ""
+		return gr, err
+	}
+	return nil, err
+}
 
-	if r.Token != "" {
-		auth = &http.BasicAuth{
-			Username: "minigit", // anything except an empty string
-			Password: r.Token,
+// branchNotFound returns the error of branch missing from the remote.
+func (r *Repo) branchNotFound(branch string) error {
+	return fmt.Errorf("branch %q not found on remote %v", branch, r.URL)
+}
+
+// isMissingRef checks if err is the error of go-git fetching
+// a reference missing from the remote.
+func isMissingRef(err error) bool {
+	return err != nil && (err == plumbing.ErrReferenceNotFound ||
+		strings.HasPrefix(err.Error(), "couldn't find remote ref"))
+}
+
+// switchBranch checks out r.Branch if HEAD is on another branch or detached,
+// creating the local branch from the remote one if needed.
+func (r *Repo) switchBranch(ctx context.Context, gr *git.Repository, w *git.Worktree) error {
+	branch := plumbing.NewBranchReferenceName(r.Branch)
+	head, err := gr.Head()
+	if err != nil {
+		return err
+	}
+	if head.Name() == branch {
+		return nil
+	}
+
+	if err := r.fetch(ctx, gr); err != nil {
+		return err
+	}
+	remote, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return r.branchNotFound(r.Branch)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts := &git.CheckoutOptions{Branch: branch, Force: r.Clean}
+	if _, err := gr.Reference(branch, false); err == plumbing.ErrReferenceNotFound {
+		// track the remote branch
+		err := gr.CreateBranch(&config.Branch{Name: r.Branch, Remote: r.remoteName(), Merge: branch})
+		if err != nil && err != git.ErrBranchExists {
+			return err
 		}
+		opts.Hash, opts.Create = remote.Hash(), true
+	}
+	if err := w.Checkout(opts); err != nil {
+		return err
+	}
+	if head.Name() == plumbing.HEAD {
+		// e.g. left at a commit pinned before
+		Logger().Printf("Reattached detached %v to branch %v.\n", r.Path, r.Branch)
+		return nil
+	}
+	Logger().Printf("Switched %v to branch %v.\n", r.Path, r.Branch)
+	return nil
+}
+
+// resetHard fetches then resets the worktree to the remote branch,
+// discarding local changes.
+func (r *Repo) resetHard(ctx context.Context, gr *git.Repository, w *git.Worktree) error {
+	if err := r.fetch(ctx, gr); err != nil {
+		return err
 	}
 
-	gr, err := git.PlainClone(r.Path, false, &git.CloneOptions{
-		URL:               r.URL.Val(),
-		Auth:              auth,
-		ReferenceName:     plumbing.ReferenceName("refs/heads/" + r.Branch),
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err != nil {
+		return err
+	}
+	if err := r.checkHead(gr, ref.Hash()); err != nil {
+		return err
+	}
+
+	if status, err := w.Status(); err == nil && !status.IsClean() {
+		Logger().Printf("Discarding local changes in %v.\n", r.Path)
+	}
+
+	err = w.Reset(&git.ResetOptions{
+		Commit: ref.Hash(),
+		Mode:   git.HardReset,
 	})
 	if err != nil {
 		return err
 	}
+	return r.pulledHead(ctx, gr)
+}
 
+// pulledHead records HEAD of gr as the most recent commit
+// after a successful pull. The submodules are updated after
+// a clone or if HEAD changed.
+func (r *Repo) pulledHead(ctx context.Context, gr *git.Repository) error {
 	ref, err := gr.Head()
 	if err != nil {
 		return err
 	}
-
 	commit, err := gr.CommitObject(ref.Hash())
 	if err != nil {
 		return err
 	}
+	// the pulls moving HEAD all end here, the rewinds
+	// not refused before moving the worktree are undone
+	if err := r.checkHead(gr, commit.Hash); err != nil {
+		if restoreErr := r.restoreHead(gr, commit); restoreErr != nil {
+			Logger().Printf("Restoring %v to %v failed: %v\n", r.label(), r.lastCommit, restoreErr)
+		}
+		return err
+	}
+
+	if !r.pulled || commit.Hash.String() != r.lastCommit {
+		if err := r.updateSubmodules(ctx, gr); err != nil {
+			return err
+		}
+	}
 
 	r.pulled = true
 	r.lastPull = time.Now()
-	Logger().Printf("%v pulled.\n", r.URL)
-	r.lastCommit = commit.String()
+	r.logEvent(LogNormal, "pulled", commit.Hash.String(), nil, "%v pulled.\n", r.label())
+	if commit.Hash.String() != r.lastCommit {
+		r.logEvent(LogQuiet, "commit", commit.Hash.String(), nil, "%v is at commit %v.\n", r.label(), commitSummary(commit))
+	}
+	r.lastCommit = commit.Hash.String()
 
 	return nil
 }
 
-// checkoutCommit checks out the specified commitHash.
-func (r *Repo) checkoutCommit(commitHash string) error {
+// commitSummary describes commit with its short hash,
+// author and subject e.g. 0a1b2c3 by Jane Doe: Fix layout.
+func commitSummary(commit *object.Commit) string {
+	subject := strings.TrimSpace(commit.Message)
+	if i := strings.Index(subject, "\n"); i >= 0 {
+		subject = strings.TrimSpace(subject[:i])
+	}
+	return fmt.Sprintf("%v by %v: %v", commit.Hash.String()[:7], commit.Author.Name, subject)
+}
+
+// pullOptions returns the options of a git pull.
+func (r *Repo) pullOptions() (*git.PullOptions, error) {
+	auth, err := r.auth()
+	if err != nil {
+		return nil, err
+	}
+	return &git.PullOptions{
+		Auth:          auth,
+		RemoteName:    r.remoteName(),
+		ReferenceName: plumbing.ReferenceName("refs/heads/" + r.Branch),
+		Depth:         r.depth(),
+		Progress:      r.progress(),
+	}, nil
+}
+
+// clone performs git clone.
+func (r *Repo) clone(ctx context.Context) error {
+	gr, err := r.cloneTo(ctx, r.Path)
+	if err != nil {
+		return err
+	}
+	return r.pulledHead(ctx, gr)
+}
+
+// cloneTo clones the repository into dir and checks out
+// the revision of r.
+func (r *Repo) cloneTo(ctx context.Context, dir string) (*git.Repository, error) {
+	opts, err := r.cloneOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	r.logEvent(LogVerbose, "clone", "", nil, "Cloning %v into %v.\n", r.label(), dir)
+	gr, err := git.PlainCloneContext(ctx, dir, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	// reclones are not initial clones
+	r.cloned = r.lastCommit == ""
+
+	if r.RefSpec != "" {
+		// only the branch is fetched by the clone
+		if err := r.fetch(ctx, gr); err != nil {
+			return nil, err
+		}
+	}
+	if r.detached() {
+		if err := r.checkoutTarget(gr); err != nil {
+			return nil, err
+		}
+	}
+	return gr, nil
+}
+
+// cloneOptions returns the options of a git clone.
+func (r *Repo) cloneOptions() (*git.CloneOptions, error) {
+	auth, err := r.auth()
+	if err != nil {
+		return nil, err
+	}
+	opts := &git.CloneOptions{
+		URL:           r.pullURL().Val(),
+		Auth:          auth,
+		RemoteName:    r.remoteName(),
+		ReferenceName: plumbing.ReferenceName("refs/heads/" + r.Branch),
+		Depth:         r.depth(),
+		Progress:      r.progress(),
+	}
+	if r.followsTags() || r.Tag != "" {
+		// clone the default branch, the tag
+		// is checked out afterwards
+		opts.ReferenceName = plumbing.HEAD
+		opts.Tags = git.AllTags
+	}
+	if r.DeployFile != "" {
+		// the deploy file may name a tag
+		opts.Tags = git.AllTags
+	}
+	if r.detached() {
+		// avoid populating the worktree with a revision
+		// that is going to be replaced right away
+		opts.NoCheckout = true
+	}
+	return opts, nil
+}
+
+// fetch fetches the branches and tags of the remote repository,
+// or the ref of r.RefSpec and the tags.
+func (r *Repo) fetch(ctx context.Context, gr *git.Repository) error {
+	auth, err := r.auth()
+	if err != nil {
+		return err
+	}
+	r.logf(LogVerbose, "Fetching %v.\n", r.label())
+	opts := &git.FetchOptions{
+		RemoteName: r.remoteName(),
+		Auth:       auth,
+		Depth:      r.depth(),
+		Tags:       git.AllTags,
+		Progress:   r.progress(),
+	}
+	if r.RefSpec != "" {
+		opts.RefSpecs = []config.RefSpec{r.refSpec()}
+	}
+	err = gr.FetchContext(ctx, opts)
+	if r.RefSpec != "" && isMissingRef(err) {
+		return r.refSpecNotFound()
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+// detached checks if the worktree is checked out at a pinned
+// commit or tag rather than following the branch.
+func (r *Repo) detached() bool {
+	return r.Commit != "" || r.Tag != "" || r.followsTags() || r.DeployFile != "" || r.RefSpec != ""
+}
+
+// checkoutTarget checks out the pinned commit or tag, the commit
+// or tag named by the deploy file, the ref of the refspec,
+// or the latest tag.
+func (r *Repo) checkoutTarget(gr *git.Repository) error {
+	if r.RefSpec != "" {
+		return r.checkoutRefSpec(gr)
+	}
+	if r.Commit != "" {
+		return r.checkoutPinned(gr)
+	}
+	if r.Tag != "" {
+		return r.checkoutTag(gr)
+	}
+	if r.DeployFile != "" {
+		return r.checkoutDeployFile(gr)
+	}
+	return r.checkoutLatestTag(gr)
+}
+
+// checkoutPinned checks out the pinned commit r.Commit.
+func (r *Repo) checkoutPinned(gr *git.Repository) error {
+	// ensure the commit exists before touching the worktree
+	_, err := gr.CommitObject(plumbing.NewHash(r.Commit))
+	if err == plumbing.ErrObjectNotFound {
+		return fmt.Errorf("commit %v not found in %v", r.Commit, r.URL)
+	}
+	if err != nil {
+		return err
+	}
+	return r.checkoutCommit(gr, r.Commit)
+}
+
+// reclone performs git clone again next to r.Path, then replaces the
+// files of r.Path by those of the new clone. r.Path is left untouched
+// if the clone fails.
+func (r *Repo) reclone(ctx context.Context) error {
+	dir, base := filepath.Split(filepath.Clean(r.Path))
+	tmp := filepath.Join(dir, "."+base+".reclone")
+
+	// leftover of an interrupted reclone
+	if err := gos.RemoveAll(tmp); err != nil {
+		return err
+	}
+	cloned, err := r.cloneTo(ctx, tmp)
+	if err == nil {
+		err = r.checkClonedHead(cloned)
+	}
+	if err != nil {
+		removeLeftover(tmp)
+		return err
+	}
+	if err := replaceDir(r.Path, tmp); err != nil {
+		return fmt.Errorf("replacing %v by its new clone failed: %v", r.Path, err)
+	}
+
 	gr, err := git.PlainOpen(r.Path)
 	if err != nil {
 		return err
 	}
+	r.pulled = false
+	return r.pulledHead(ctx, gr)
+}
+
+// replaceDir replaces the entries of dir by those of src,
+// which is removed afterwards.
+func replaceDir(dir, src string) error {
+	entries, err := gos.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	replaced := make(map[string]bool)
+	for _, entry := range entries {
+		replaced[entry.Name()] = true
+		name := filepath.Join(dir, entry.Name())
+		if err := gos.RemoveAll(name); err != nil {
+			return err
+		}
+		if err := gos.Rename(filepath.Join(src, entry.Name()), name); err != nil {
+			return err
+		}
+	}
+
+	previous, err := gos.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range previous {
+		if replaced[entry.Name()] {
+			continue
+		}
+		if err := gos.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return gos.RemoveAll(src)
+}
+
+// checkoutCommit checks out the specified commitHash,
+// unless it rewinds the deployed commit.
+func (r *Repo) checkoutCommit(gr *git.Repository, commitHash string) error {
+	if err := r.checkHead(gr, plumbing.NewHash(commitHash)); err != nil {
+		return err
+	}
 
 	w, err := gr.Worktree()
 	if err != nil {
 		return err
 	}
 
+	r.logf(LogVerbose, "Checking out commit %v of %v.\n", commitHash, r.label())
 	return w.Checkout(&git.CheckoutOptions{
 		Hash: plumbing.NewHash(commitHash),
 	})
@@ -223,7 +1006,10 @@ func (r *Repo) Prepare() error {
 	// if not, create directory
 	fs, err := gos.ReadDir(r.Path)
 	if err != nil || len(fs) == 0 {
-		return gos.MkdirAll(r.Path, os.FileMode(0755))
+		if err := gos.MkdirAll(r.Path, os.FileMode(0755)); err != nil {
+			return err
+		}
+		return r.checkWritable()
 	}
 
 	// validate git repo
@@ -233,6 +1019,11 @@ func (r *Repo) Prepare() error {
 			isGit = true
 			break
 		}
+		// mirrors are bare repositories
+		if r.Mirror && !f.IsDir() && f.Name() == "HEAD" {
+			isGit = true
+			break
+		}
 	}
 
 	if isGit {
@@ -241,7 +1032,7 @@ func (r *Repo) Prepare() error {
 		if repoURL, err = r.originURL(); err == nil {
 			if strings.TrimSuffix(repoURL, ".git") == strings.TrimSuffix(r.URL.Val(), ".git") {
 				r.pulled = true
-				return nil
+				return r.checkWritable()
 			}
 		}
 		if err != nil {
@@ -252,34 +1043,165 @@ func (r *Repo) Prepare() error {
 	return fmt.Errorf("cannot git clone into %v, directory not empty", r.Path)
 }
 
-// originURL retrieves remote origin url for the git repository at path
+// checkWritable checks that files can be created in r.Path,
+// as pulls would fail later with a less obvious error.
+func (r *Repo) checkWritable() error {
+	f, err := gos.TempFile(r.Path, ".caddy-git-")
+	if err != nil {
+		return fmt.Errorf("path %v is not writable: %v", r.Path, err)
+	}
+	name := f.Name()
+	f.Close()
+	return gos.Remove(name)
+}
+
+// originURL retrieves the url of the remote r.Remote
+// for the git repository at path
 func (r *Repo) originURL() (string, error) {
 	gr, err := git.PlainOpen(r.Path)
 	if err != nil {
 		return "", err
 	}
 
-	url, err := gr.Remote("origin")
+	remote, err := gr.Remote(r.remoteName())
 	if err != nil {
 		return "", err
 	}
-	return url.String(), err
+	if urls := remote.Config().URLs; len(urls) > 0 {
+		return urls[0], nil
+	}
+	return "", fmt.Errorf("remote %v has no url", r.remoteName())
+}
+
+// name returns the name identifying r in metrics and
+// endpoints, the url without credentials by default.
+func (r *Repo) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.URL.String()
+}
+
+// publicName returns the name identifying r on the status and health
+// pages, Name or the url without credentials.
+func (r *Repo) publicName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.URL.public()
+}
+
+// label returns the name identifying r in logs. It is name, or
+// the url with credentials if SetLogCredentials enabled them.
+func (r *Repo) label() string {
+	if r.Name == "" && logCredentials() {
+		return string(r.URL)
+	}
+	return r.name()
+}
+
+// remoteName returns the name of the remote repository,
+// origin by default.
+func (r *Repo) remoteName() string {
+	if r.Remote == "" {
+		return "origin"
+	}
+	return r.Remote
 }
 
 // execThen executes r.Then.
 // It is trigged after successful git pull
 func (r *Repo) execThen() error {
+	return r.execCommands(r.Then)
+}
+
+// execCommands executes commands, stopping at the first failure
+// unless r.ThenContinue is set.
+func (r *Repo) execCommands(commands []Then) error {
+	env := r.thenEnv()
 	var errs error
-	for _, command := range r.Then {
-		err := command.Exec(r.Path)
+	for _, command := range commands {
+		if c, ok := command.(*changedThen); ok && !c.runs(r.changed) {
+			Logger().Printf("Command '%v' skipped, no changed file matches %v.\n", command.Command(), c.pattern)
+			continue
+		}
+		ctx, cancel := r.thenContext()
+		err := execCommand(ctx, command, r.Path, env)
+		cancel()
 		if err == nil {
 			Logger().Printf("Command '%v' successful.\n", command.Command())
+			continue
 		}
 		errs = mergeErrors(errs, err)
+		if !r.ThenContinue {
+			// the remaining commands may depend on the failed one
+			break
+		}
 	}
 	return errs
 }
 
+// stopThen kills the running background processes of r.Then
+// and r.ThenOnce.
+func (r *Repo) stopThen() {
+	for _, commands := range [][]Then{r.ThenOnce, r.Then} {
+		for _, command := range commands {
+			if g, ok := command.(*gitCmd); ok {
+				g.stop()
+			}
+		}
+	}
+}
+
+// execOnError executes r.OnError after the pull failed with err.
+// The failures of the commands are only logged.
+func (r *Repo) execOnError(err error) {
+	env := append(r.thenEnv(), "CADDY_GIT_ERROR="+err.Error())
+	for _, command := range r.OnError {
+		ctx, cancel := r.thenContext()
+		if err := execCommand(ctx, command, r.Path, env); err != nil {
+			Logger().Printf("Error command '%v' failed: %v\n", command.Command(), err)
+		}
+		cancel()
+	}
+}
+
+// thenContext returns the context of a Then command, done when
+// r is cancelled or r.ThenTimeout elapses.
+func (r *Repo) thenContext() (context.Context, context.CancelFunc) {
+	if r.ThenTimeout > 0 {
+		return context.WithTimeout(r.context(), r.ThenTimeout)
+	}
+	return context.WithCancel(r.context())
+}
+
+// thenEnv returns the environment variables passed to r.Then
+// describing the deployed commit, followed by r.ThenEnv.
+func (r *Repo) thenEnv() []string {
+	env := []string{
+		"CADDY_GIT_COMMIT=" + r.lastCommit,
+		"CADDY_GIT_BRANCH=" + r.Branch,
+		"CADDY_GIT_REPO=" + r.redact(r.URL.String()),
+	}
+	if r.changed != nil {
+		env = append(env, "CADDY_GIT_CHANGED_FILES="+strings.Join(r.changed, "\n"))
+	}
+	return append(env, r.ThenEnv...)
+}
+
+// writeDeployMarker writes the deployed commit and the time of
+// the pull to r.DeployMarker, if set. Failures are only logged.
+func (r *Repo) writeDeployMarker() {
+	if r.DeployMarker == "" {
+		return
+	}
+	name := filepath.Join(r.Path, r.DeployMarker)
+	data := fmt.Sprintf("%v\n%v\n", r.lastCommit, r.lastPull.UTC().Format(time.RFC3339))
+	if err := gos.WriteFile(name, []byte(data), os.FileMode(0644)); err != nil {
+		Logger().Printf("Writing deploy marker %v failed: %v\n", name, err)
+	}
+}
+
 func mergeErrors(errs ...error) error {
 	if len(errs) == 0 {
 		return nil
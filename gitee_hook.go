@@ -3,10 +3,8 @@ package git
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
 // GiteeHook is webhook for gitee.com
@@ -16,6 +14,11 @@ type giteePush struct {
 	Ref string `json:"ref"`
 }
 
+// RequiresSecret satisfies hookHandler.
+func (g GiteeHook) RequiresSecret() bool {
+	return true
+}
+
 // DoesHandle satisfies hookHandler.
 func (g GiteeHook) DoesHandle(h http.Header) bool {
 	event := h.Get("X-Gitee-Event")
@@ -40,7 +43,7 @@ func (g GiteeHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (i
 
 	err = g.handleToken(r, body, repo.Hook.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return http.StatusForbidden, err
 	}
 
 	event := r.Header.Get("X-Gitee-Event")
@@ -50,17 +53,12 @@ func (g GiteeHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (i
 
 	switch event {
 	case "Push Hook":
-		err = g.handlePush(body, repo)
-		if !hookIgnored(err) && err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(g.handlePush(body, repo))
 
 		// return 400 if we do not handle the event type.
 	default:
 		return http.StatusBadRequest, nil
 	}
-
-	return http.StatusOK, err
 }
 
 // handleToken checks for an optional token in the request. Gitee's webhook tokens are just
@@ -89,20 +87,6 @@ func (g GiteeHook) handlePush(body []byte, repo *Repo) error {
 		return err
 	}
 
-	// extract the branch being pushed from the ref string
-	// and if it matches with our locally tracked one, pull.
-	refSlice := strings.Split(push.Ref, "/")
-	if len(refSlice) != 3 {
-		return errors.New("the push request contained an invalid reference string")
-	}
-
-	branch := refSlice[2]
-	if branch != repo.Branch {
-		return hookIgnoredError{hookType: hookName(g), err: fmt.Errorf("found different branch %v", branch)}
-	}
-
-	Logger().Print("Received pull notification for the tracking branch, updating...\n")
-	repo.Pull()
-
-	return nil
+	// pull if the pushed branch or tag is one pulled by repo
+	return pullPushedRef(g, repo, push.Ref)
 }
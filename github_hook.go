@@ -3,10 +3,11 @@ package git
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"hash"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -27,6 +28,11 @@ type ghPush struct {
 	Ref string `json:"ref"`
 }
 
+// RequiresSecret satisfies hookHandler.
+func (g GithubHook) RequiresSecret() bool {
+	return true
+}
+
 // DoesHandle satisfies hookHandler.
 func (g GithubHook) DoesHandle(h http.Header) bool {
 	userAgent := h.Get("User-Agent")
@@ -46,10 +52,13 @@ func (g GithubHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 
 	// read full body - required for signature
 	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusRequestTimeout, errors.New("could not read body from request")
+	}
 
 	err = g.handleSignature(r, body, repo.Hook.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return http.StatusForbidden, err
 	}
 
 	event := r.Header.Get("X-Github-Event")
@@ -59,17 +68,16 @@ func (g GithubHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 
 	switch event {
 	case "ping":
+		// answer without pulling
 		w.Write([]byte("pong"))
 	case "push":
-		err = g.handlePush(body, repo)
-		if !hookIgnored(err) && err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(handleDelivery(g, repo, r.Header.Get("X-Github-Delivery"), func() error {
+			return g.handlePush(body, repo)
+		}))
 	case "release":
-		err = g.handleRelease(body, repo)
-		if err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(handleDelivery(g, repo, r.Header.Get("X-Github-Delivery"), func() error {
+			return g.handleRelease(body, repo)
+		}))
 
 	// return 400 if we do not handle the event type.
 	// This is to visually show the user a configuration error in the GH ui.
@@ -77,27 +85,44 @@ func (g GithubHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 		return http.StatusBadRequest, nil
 	}
 
-	return http.StatusOK, err
+	return http.StatusOK, nil
 }
 
-// Check for an optional signature in the request
-// if it is signed, verify the signature.
+// handleSignature verifies the signature of the request if a secret
+// is set, in which case the signature is required. The SHA256 signature
+// is preferred over the SHA1 one.
 func (g GithubHook) handleSignature(r *http.Request, body []byte, secret string) error {
-	signature := r.Header.Get("X-Hub-Signature")
-	if signature != "" {
-		if secret == "" {
+	var (
+		signature string
+		hashFunc  func() hash.Hash
+	)
+	if signature = r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		signature, hashFunc = strings.TrimPrefix(signature, "sha256="), sha256.New
+	} else if signature = r.Header.Get("X-Hub-Signature"); signature != "" {
+		signature, hashFunc = strings.TrimPrefix(signature, "sha1="), sha1.New
+	}
+
+	if secret == "" {
+		if signature != "" {
 			Logger().Print("Unable to verify request signature. Secret not set in caddyfile!\n")
-		} else {
-			mac := hmac.New(sha1.New, []byte(secret))
-			mac.Write(body)
-			expectedMac := hex.EncodeToString(mac.Sum(nil))
-
-			if signature[5:] != expectedMac {
-				return errors.New("could not verify request signature. The signature is invalid")
-			}
 		}
+		return nil
+	}
+
+	if signature == "" {
+		return errors.New("the 'X-Hub-Signature-256' header is required but was missing")
+	}
+
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("could not verify request signature. The signature is invalid")
 	}
 
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(actual, mac.Sum(nil)) {
+		return errors.New("could not verify request signature. The signature is invalid")
+	}
 	return nil
 }
 
@@ -109,22 +134,8 @@ func (g GithubHook) handlePush(body []byte, repo *Repo) error {
 		return err
 	}
 
-	// extract the branch being pushed from the ref string
-	// and if it matches with our locally tracked one, pull.
-	refSlice := strings.Split(push.Ref, "/")
-	if len(refSlice) != 3 {
-		return errors.New("the push request contained an invalid reference string")
-	}
-
-	branch := refSlice[2]
-
-	if branch != repo.Branch {
-		return hookIgnoredError{hookType: hookName(g), err: fmt.Errorf("found different branch %v", branch)}
-	}
-
-	Logger().Println("Received pull notification for the tracking branch, updating...")
-	repo.Pull()
-	return nil
+	// pull if the pushed branch or tag is one pulled by repo
+	return pullPushedRef(g, repo, push.Ref)
 }
 
 func (g GithubHook) handleRelease(body []byte, repo *Repo) error {
@@ -143,8 +154,8 @@ func (g GithubHook) handleRelease(body []byte, repo *Repo) error {
 
 	// Update the local branch to the release tag name
 	// this will pull the release tag.
-	repo.Branch = release.Release.TagName
-	repo.Pull()
-
-	return nil
+	return pullHook(repo, func(pull func() error) error {
+		repo.Branch = release.Release.TagName
+		return pull()
+	})
 }
@@ -2,9 +2,18 @@ package git
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
 )
 
 func TestGithubDeployPush(t *testing.T) {
@@ -20,6 +29,7 @@ func TestGithubDeployPush(t *testing.T) {
 		{"", "", "", 400},
 		{"", "push", "", 400},
 		{pushBodyOther, "push", "", 200},
+		{pushBodyTag, "push", "", 200},
 		{pushBodyPartial, "push", "", 400},
 		{"", "release", "", 400},
 		{"", "ping", "pong", 200},
@@ -33,6 +43,7 @@ func TestGithubDeployPush(t *testing.T) {
 		if test.event != "" {
 			req.Header.Add("X-Github-Event", test.event)
 		}
+		req.Header.Add("X-Hub-Signature-256", ghSign(sha256.New, "sha256=", test.body, repo.Hook.Secret))
 
 		rec := httptest.NewRecorder()
 
@@ -49,6 +60,90 @@ func TestGithubDeployPush(t *testing.T) {
 
 }
 
+func TestGithubDuplicateDelivery(t *testing.T) {
+	repo := pulledRepo(HookConfig{URL: "/github_deploy", Secret: "supersecret"})
+	ghHook := GithubHook{}
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	for i, id := range []string{"72d3162e", "72d3162e", "a5c1f3e8", ""} {
+		req, err := http.NewRequest("POST", "/github_deploy", bytes.NewBufferString(pushMasterBody))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-Github-Delivery", id)
+		req.Header.Set("X-Hub-Signature-256", ghSign(sha256.New, "sha256=", pushMasterBody, repo.Hook.Secret))
+
+		code, _ := serveHook(ghHook, httptest.NewRecorder(), req, repo)
+		if code != http.StatusOK {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, http.StatusOK, code)
+		}
+	}
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if n := strings.Count(string(out), "Received pull notification"); n != 3 {
+		t.Errorf("Expected 3 pulls found %v", n)
+	}
+	if !strings.Contains(string(out), "duplicate delivery 72d3162e") {
+		t.Errorf("Expected duplicate delivery logged found %q", out)
+	}
+}
+
+// ghSign returns the signature of body as sent by GitHub.
+func ghSign(h func() hash.Hash, prefix, body, secret string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(body))
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestGithubSignature(t *testing.T) {
+	ghHook := GithubHook{}
+
+	for i, test := range []struct {
+		secret       string
+		sha256       string
+		sha1         string
+		code         int
+		responseBody string
+	}{
+		{"supersecret", ghSign(sha256.New, "sha256=", "", "supersecret"), "", 200, "pong"},
+		{"supersecret", "", ghSign(sha1.New, "sha1=", "", "supersecret"), 200, "pong"},
+		// sha256 is preferred
+		{"supersecret", ghSign(sha256.New, "sha256=", "", "supersecret"), ghSign(sha1.New, "sha1=", "", "wrong"), 200, "pong"},
+		{"supersecret", ghSign(sha256.New, "sha256=", "", "wrong"), ghSign(sha1.New, "sha1=", "", "supersecret"), 403, ""},
+		{"supersecret", "", ghSign(sha1.New, "sha1=", "", "wrong"), 403, ""},
+		{"supersecret", "sha256=forged", "", 403, ""},
+		{"supersecret", "", "", 403, ""},
+		{"", "", "", 200, "pong"},
+	} {
+		repo := &Repo{Branch: "master", Hook: HookConfig{URL: "/github_deploy", Secret: test.secret}}
+
+		req, err := http.NewRequest("POST", "/github_deploy", bytes.NewBuffer(nil))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Add("X-Github-Event", "ping")
+		if test.sha256 != "" {
+			req.Header.Add("X-Hub-Signature-256", test.sha256)
+		}
+		if test.sha1 != "" {
+			req.Header.Add("X-Hub-Signature", test.sha1)
+		}
+
+		rec := httptest.NewRecorder()
+		code, _ := ghHook.Handle(rec, req, repo)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+		if rec.Body.String() != test.responseBody {
+			t.Errorf("Test %d: Expected response body to be '%v' but was '%v'", i, test.responseBody, rec.Body.String())
+		}
+	}
+}
+
 var pushBodyPartial = `
 {
   "ref": ""
@@ -60,3 +155,9 @@ var pushBodyOther = `
   "ref": "refs/heads/some-other-branch"
 }
 `
+
+var pushBodyTag = `
+{
+  "ref": "refs/tags/v1.0.0"
+}
+`
@@ -1,12 +1,11 @@
 package git
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
 // GitlabHook is webhook for gitlab.com
@@ -16,6 +15,11 @@ type glPush struct {
 	Ref string `json:"ref"`
 }
 
+// RequiresSecret satisfies hookHandler.
+func (g GitlabHook) RequiresSecret() bool {
+	return true
+}
+
 // DoesHandle satisfies hookHandler.
 func (g GitlabHook) DoesHandle(h http.Header) bool {
 	event := h.Get("X-Gitlab-Event")
@@ -40,7 +44,7 @@ func (g GitlabHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 
 	err = g.handleToken(r, body, repo.Hook.Secret)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return http.StatusForbidden, err
 	}
 
 	event := r.Header.Get("X-Gitlab-Event")
@@ -50,34 +54,32 @@ func (g GitlabHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 
 	switch event {
 	case "Push Hook":
-		err = g.handlePush(body, repo)
-		if !hookIgnored(err) && err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(g.handlePush(body, repo))
 
 	// return 400 if we do not handle the event type.
 	default:
 		return http.StatusBadRequest, nil
 	}
-
-	return http.StatusOK, err
 }
 
-// handleToken checks for an optional token in the request. GitLab's webhook tokens are just
-// simple strings that get sent as a header with the hook request. If one
-// exists, verify that it matches the secret in the Caddy configuration.
+// handleToken checks the token in the request. GitLab's webhook tokens are just
+// simple strings that get sent as a header with the hook request. If a secret
+// is set in the Caddy configuration, the token is required and must match it.
 func (g GitlabHook) handleToken(r *http.Request, body []byte, secret string) error {
 	token := r.Header.Get("X-Gitlab-Token")
-	if token != "" {
-		if secret == "" {
+	if secret == "" {
+		if token != "" {
 			Logger().Print("Unable to verify request. Secret not set in caddyfile!\n")
-		} else {
-			if token != secret {
-				return errors.New("Unable to verify request. The token and specified secret do not match!")
-			}
 		}
+		return nil
 	}
 
+	if token == "" {
+		return errors.New("the 'X-Gitlab-Token' header is required but was missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("Unable to verify request. The token and specified secret do not match!")
+	}
 	return nil
 }
 
@@ -89,20 +91,6 @@ func (g GitlabHook) handlePush(body []byte, repo *Repo) error {
 		return err
 	}
 
-	// extract the branch being pushed from the ref string
-	// and if it matches with our locally tracked one, pull.
-	refSlice := strings.Split(push.Ref, "/")
-	if len(refSlice) != 3 {
-		return errors.New("the push request contained an invalid reference string")
-	}
-
-	branch := refSlice[2]
-	if branch != repo.Branch {
-		return hookIgnoredError{hookType: hookName(g), err: fmt.Errorf("found different branch %v", branch)}
-	}
-
-	Logger().Print("Received pull notification for the tracking branch, updating...\n")
-	repo.Pull()
-
-	return nil
+	// pull if the pushed branch or tag is one pulled by repo
+	return pullPushedRef(g, repo, push.Ref)
 }
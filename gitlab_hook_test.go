@@ -8,21 +8,31 @@ import (
 )
 
 func TestGitlabDeployPush(t *testing.T) {
-	repo := &Repo{Branch: "master", Hook: HookConfig{URL: "/gitlab_deploy"}}
 	glHook := GitlabHook{}
 
 	for i, test := range []struct {
 		body         string
 		event        string
+		secret       string
+		token        string
 		responseBody string
 		code         int
+		ignored      bool
 	}{
-		{"", "", "", 400},
-		{"", "Push Hook", "", 400},
-		{pushGLBodyOther, "Push Hook", "", 200},
-		{pushGLBodyPartial, "Push Hook", "", 400},
-		{"", "Some other Event", "", 400},
+		{"", "", "", "", "", 400, false},
+		{"", "Push Hook", "", "", "", 400, false},
+		{pushGLBodyOther, "Push Hook", "", "", "", 200, true},
+		{pushGLBodyPartial, "Push Hook", "", "", "", 400, false},
+		{"", "Some other Event", "", "", "", 400, false},
+		{pushGLBodyMaster, "Push Hook", "", "", "", 200, false},
+		{pushGLBodyMaster, "Push Hook", "", "token", "", 200, false},
+		{pushGLBodyMaster, "Push Hook", "supersecret", "supersecret", "", 200, false},
+		{pushGLBodyOther, "Push Hook", "supersecret", "supersecret", "", 200, true},
+		{pushGLBodyMaster, "Push Hook", "supersecret", "", "", 403, false},
+		{pushGLBodyMaster, "Push Hook", "supersecret", "wrongsecret", "", 403, false},
+		{pushGLBodyFeature, "Push Hook", "", "", "", 200, true},
 	} {
+		repo := pulledRepo(HookConfig{URL: "/gitlab_deploy", Secret: test.secret})
 
 		req, err := http.NewRequest("POST", "/gitlab_deploy", bytes.NewBuffer([]byte(test.body)))
 		if err != nil {
@@ -32,6 +42,9 @@ func TestGitlabDeployPush(t *testing.T) {
 		if test.event != "" {
 			req.Header.Add("X-Gitlab-Event", test.event)
 		}
+		if test.token != "" {
+			req.Header.Add("X-Gitlab-Token", test.token)
+		}
 
 		rec := httptest.NewRecorder()
 
@@ -41,6 +54,10 @@ func TestGitlabDeployPush(t *testing.T) {
 			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
 		}
 
+		if hookIgnored(err) != test.ignored {
+			t.Errorf("Test %d: Expected webhook ignored to be %v but found error %v", i, test.ignored, err)
+		}
+
 		if rec.Body.String() != test.responseBody {
 			t.Errorf("Test %d: Expected response body to be '%v' but was '%v'", i, test.responseBody, rec.Body.String())
 		}
@@ -59,3 +76,23 @@ var pushGLBodyOther = `
   "ref": "refs/heads/some-other-branch"
 }
 `
+
+var pushGLBodyMaster = `
+{
+  "object_kind": "push",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "ref": "refs/heads/master",
+  "user_name": "John Smith",
+  "project": {
+    "name": "Diaspora",
+    "default_branch": "master"
+  }
+}
+`
+
+var pushGLBodyFeature = `
+{
+  "ref": "refs/heads/feature/master"
+}
+`
@@ -1,10 +1,13 @@
 package gitos
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 )
 
@@ -48,6 +51,10 @@ type Cmd interface {
 	// Dir sets the working directory of the command.
 	Dir(string)
 
+	// Env adds the environment variables in the form key=value
+	// to the environment inherited by the command.
+	Env([]string)
+
 	// Stdin sets the process's standard input.
 	Stdin(io.Reader)
 
@@ -59,6 +66,14 @@ type Cmd interface {
 
 	// Process is the underlying process, once started.
 	Process() *os.Process
+
+	// ProcessGroup starts the command in a new process group,
+	// for Kill to also kill the processes it starts.
+	ProcessGroup()
+
+	// Kill kills the started process, and its process group
+	// if started in one.
+	Kill() error
 }
 
 // gitCmd represents external commands executed by git.
@@ -71,6 +86,13 @@ func (g *gitCmd) Dir(dir string) {
 	g.Cmd.Dir = dir
 }
 
+// Env adds env to the environment of the command.
+func (g *gitCmd) Env(env []string) {
+	if len(env) > 0 {
+		g.Cmd.Env = append(os.Environ(), env...)
+	}
+}
+
 // Stdin sets the process's standard input.
 func (g *gitCmd) Stdin(stdin io.Reader) {
 	g.Cmd.Stdin = stdin
@@ -90,6 +112,19 @@ func (g *gitCmd) Process() *os.Process {
 	return g.Cmd.Process
 }
 
+// ProcessGroup starts the command in a new process group.
+func (g *gitCmd) ProcessGroup() {
+	setProcessGroup(g.Cmd)
+}
+
+// Kill kills the process and its process group.
+func (g *gitCmd) Kill() error {
+	if g.Cmd.Process == nil {
+		return nil
+	}
+	return killProcessGroup(g.Cmd)
+}
+
 // OS is an abstraction for required OS level functions.
 type OS interface {
 	// Command returns the Cmd to execute the named program with the
@@ -110,6 +145,18 @@ type OS interface {
 	// Remove removes the named file or directory.
 	Remove(string) error
 
+	// RemoveAll removes path and any children it contains.
+	RemoveAll(string) error
+
+	// Rename renames (moves) oldpath to newpath.
+	Rename(string, string) error
+
+	// Readlink returns the destination of the named symbolic link.
+	Readlink(string) (string, error)
+
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(string, string) error
+
 	// ReadDir reads the directory named by dirname and returns a list of
 	// directory entries.
 	ReadDir(string) ([]os.FileInfo, error)
@@ -126,6 +173,16 @@ type OS interface {
 	// TempDir returns the default directory to use for temporary files.
 	TempDir() string
 
+	// OpenFile opens the named file with the specified flag (os.O_RDONLY
+	// etc.) and permission bits.
+	OpenFile(string, int, os.FileMode) (File, error)
+
+	// WriteFile writes data to the named file, creating it if necessary.
+	WriteFile(string, []byte, os.FileMode) error
+
+	// ReadFile reads the named file and returns its contents.
+	ReadFile(string) ([]byte, error)
+
 	// Sleep pauses the current goroutine for at least the duration d. A
 	// negative or zero duration causes Sleep to return immediately.
 	Sleep(time.Duration)
@@ -136,8 +193,20 @@ type OS interface {
 
 	// TimeSince returns the time elapsed since the argument.
 	TimeSince(time.Time) time.Duration
+
+	// Int63n returns a non-negative pseudo-random number in [0,n).
+	// It panics if n <= 0.
+	Int63n(int64) int64
+
+	// LockFile acquires an exclusive lock on the named file, creating it
+	// if necessary, without waiting. ErrLocked is returned if the lock is
+	// already held. The returned function releases the lock.
+	LockFile(string) (func() error, error)
 }
 
+// ErrLocked is returned by LockFile when the lock is already held.
+var ErrLocked = errors.New("file is locked")
+
 // Ticker is an abstraction for Ticker (time.Ticker)
 type Ticker interface {
 	C() <-chan time.Time
@@ -177,6 +246,26 @@ func (g GitOS) Remove(name string) error {
 	return os.Remove(name)
 }
 
+// RemoveAll calls os.RemoveAll.
+func (g GitOS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Rename calls os.Rename.
+func (g GitOS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Readlink calls os.Readlink.
+func (g GitOS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Symlink calls os.Symlink.
+func (g GitOS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
 // LookPath calls exec.LookPath.
 func (g GitOS) LookPath(file string) (string, error) {
 	return exec.LookPath(file)
@@ -202,6 +291,21 @@ func (g GitOS) Command(name string, args ...string) Cmd {
 	return &gitCmd{exec.Command(name, args...)}
 }
 
+// ReadFile calls ioutil.ReadFile.
+func (g GitOS) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+// OpenFile calls os.OpenFile.
+func (g GitOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// WriteFile calls ioutil.WriteFile.
+func (g GitOS) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(filename, data, perm)
+}
+
 // Sleep calls time.Sleep.
 func (g GitOS) Sleep(d time.Duration) {
 	time.Sleep(d)
@@ -216,3 +320,16 @@ func (g GitOS) NewTicker(d time.Duration) Ticker {
 func (g GitOS) TimeSince(t time.Time) time.Duration {
 	return time.Since(t)
 }
+
+// random is the source of GitOS.Int63n, seeded at startup.
+var random = struct {
+	*rand.Rand
+	sync.Mutex
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Int63n calls rand.Int63n.
+func (g GitOS) Int63n(n int64) int64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.Int63n(n)
+}
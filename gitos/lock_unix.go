@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package gitos
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile locks the named file with flock. The lock is released
+// by the system if the process exits without releasing it.
+func (g GitOS) LockFile(name string) (func() error, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return f.Close, nil
+}
@@ -0,0 +1,18 @@
+package gitos
+
+import "os"
+
+// LockFile creates the named file exclusively, the lock is held as long
+// as the file exists. Unlike flock, a lock file left behind by a crashed
+// process must be removed by hand.
+func (g GitOS) LockFile(name string) (func() error, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() error { return os.Remove(name) }, nil
+}
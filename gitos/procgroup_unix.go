@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package gitos
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setpgid {
+		return cmd.Process.Kill()
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
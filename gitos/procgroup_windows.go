@@ -0,0 +1,11 @@
+package gitos
+
+import "os/exec"
+
+// process groups are not supported, only the process is killed.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -3,9 +3,12 @@
 package gittest
 
 import (
+	"errors"
 	"io"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -24,11 +27,45 @@ var TempFileName = "tempfile"
 // TimeSpeed is how faster the mocked gitos.Ticker and gitos.Sleep should run.
 var TimeSpeed = 5
 
-// dirs mocks a fake git dir if filename is "gitdir".
-var dirs = map[string][]os.FileInfo{
+// dirs mocks a fake git dir if filename is "gitdir",
+// and the directories set with SetDir.
+var dirs = struct {
+	entries map[string][]os.FileInfo
+	sync.Mutex
+}{entries: map[string][]os.FileInfo{
 	"gitdir": {
 		fakeInfo{name: ".git", dir: true},
 	},
+}}
+
+// SetDir makes the mocked gitos.OS's ReadDir() list the files names
+// of 1024 bytes each in dir. No names removes dir.
+func SetDir(dir string, names ...string) {
+	dirs.Lock()
+	defer dirs.Unlock()
+	if len(names) == 0 {
+		delete(dirs.entries, dir)
+		return
+	}
+	entries := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		entries[i] = fakeInfo{name: name}
+	}
+	dirs.entries[dir] = entries
+}
+
+// readOnly records the directories in which mocked gitos.OS's TempFile() fails.
+var readOnly = struct {
+	dirs map[string]bool
+	sync.Mutex
+}{dirs: make(map[string]bool)}
+
+// SetReadOnly makes the creation of temporary files in dir with the mocked
+// gitos.OS's TempFile() fail with a permission error, or succeed again.
+func SetReadOnly(dir string, ro bool) {
+	readOnly.Lock()
+	readOnly.dirs[dir] = ro
+	readOnly.Unlock()
 }
 
 // Open creates a new mock gitos.File.
@@ -41,6 +78,85 @@ func Sleep(d time.Duration) {
 	FakeOS.Sleep(d)
 }
 
+// sleeps records the durations of the calls to the mocked gitos.OS's Sleep().
+var sleeps struct {
+	d []time.Duration
+	sync.Mutex
+}
+
+// Sleeps returns the durations of the calls to the mocked gitos.OS's Sleep()
+// since the last call to ResetSleeps.
+func Sleeps() []time.Duration {
+	sleeps.Lock()
+	defer sleeps.Unlock()
+	return append([]time.Duration(nil), sleeps.d...)
+}
+
+// ResetSleeps clears the recorded durations of the calls to the mocked
+// gitos.OS's Sleep().
+func ResetSleeps() {
+	sleeps.Lock()
+	sleeps.d = nil
+	sleeps.Unlock()
+}
+
+// files records the data written by the mocked gitos.OS's WriteFile(),
+// read by its ReadFile().
+var files = struct {
+	data map[string][]byte
+	sync.Mutex
+}{data: make(map[string][]byte)}
+
+// WrittenFile returns the data last written to the named file
+// with the mocked gitos.OS's WriteFile(), or to the file opened
+// with its OpenFile().
+func WrittenFile(name string) ([]byte, bool) {
+	files.Lock()
+	defer files.Unlock()
+	data, ok := files.data[name]
+	return data, ok
+}
+
+// locks records the files locked with the mocked gitos.OS's LockFile().
+var locks = struct {
+	held map[string]bool
+	sync.Mutex
+}{held: make(map[string]bool)}
+
+// Locked reports whether the named file is locked
+// with the mocked gitos.OS's LockFile().
+func Locked(name string) bool {
+	locks.Lock()
+	defer locks.Unlock()
+	return locks.held[name]
+}
+
+// openedFile is a mock gitos.File opened with the mocked gitos.OS's
+// OpenFile(), appending the data written to the recorded files.
+type openedFile struct {
+	fakeFile
+}
+
+func (f *openedFile) Write(b []byte) (int, error) {
+	files.Lock()
+	files.data[f.name] = append(files.data[f.name], b...)
+	files.Unlock()
+	return len(b), nil
+}
+
+// random is the source of the mocked gitos.OS's Int63n().
+var random = struct {
+	*rand.Rand
+	sync.Mutex
+}{Rand: rand.New(rand.NewSource(1))}
+
+// Seed seeds the source of the mocked gitos.OS's Int63n().
+func Seed(seed int64) {
+	random.Lock()
+	random.Seed(seed)
+	random.Unlock()
+}
+
 // NewLogger creates a logger that logs to f
 func NewLogger(f gitos.File) *log.Logger {
 	return log.New(f, "", 0)
@@ -60,7 +176,7 @@ func (f *fakeFile) Name() string {
 }
 
 func (f *fakeFile) Stat() (os.FileInfo, error) {
-	return fakeInfo{name: f.name}, nil
+	return fakeInfo{name: f.name, mode: f.info.mode}, nil
 }
 
 func (f *fakeFile) Close() error {
@@ -90,34 +206,131 @@ func (f *fakeFile) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// processes records the fake processes of long running commands.
+var processes = struct {
+	long    map[string]bool
+	started map[string][]*Process
+	sync.Mutex
+}{
+	long:    make(map[string]bool),
+	started: make(map[string][]*Process),
+}
+
+// LongRunning makes the processes started by the mocked gitos.Cmd of
+// the command name run until killed or terminated with Exit, instead
+// of exiting immediately.
+func LongRunning(name string) {
+	processes.Lock()
+	processes.long[name] = true
+	processes.Unlock()
+}
+
+// Processes returns the processes of the long running command name
+// started so far, in order.
+func Processes(name string) []*Process {
+	processes.Lock()
+	defer processes.Unlock()
+	return append([]*Process(nil), processes.started[name]...)
+}
+
+// Process is a fake process of a long running command.
+type Process struct {
+	done   chan struct{}
+	err    error
+	killed bool
+	sync.Mutex
+}
+
+// Exit terminates the process with err, e.g. to simulate a crash.
+func (p *Process) Exit(err error) {
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-p.done:
+	default:
+		p.err = err
+		close(p.done)
+	}
+}
+
+// Exited reports whether the process terminated.
+func (p *Process) Exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Killed reports whether the process was killed.
+func (p *Process) Killed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.killed
+}
+
+func (p *Process) kill() {
+	p.Lock()
+	if !p.Exited() {
+		p.killed = true
+	}
+	p.Unlock()
+	p.Exit(errors.New("signal: killed"))
+}
+
 // fakeCmd is a mock gitos.Cmd.
-type fakeCmd struct{}
+type fakeCmd struct {
+	name    string
+	process *Process
+}
 
-func (f fakeCmd) Run() error {
+func (f *fakeCmd) Run() error {
 	return nil
 }
 
-func (f fakeCmd) Start() error {
+func (f *fakeCmd) Start() error {
+	processes.Lock()
+	defer processes.Unlock()
+	if processes.long[f.name] {
+		f.process = &Process{done: make(chan struct{})}
+		processes.started[f.name] = append(processes.started[f.name], f.process)
+	}
 	return nil
 }
 
-func (f fakeCmd) Wait() error {
-	return nil
+func (f *fakeCmd) Wait() error {
+	if f.process == nil {
+		return nil
+	}
+	<-f.process.done
+	return f.process.err
 }
 
-func (f fakeCmd) Output() ([]byte, error) {
+func (f *fakeCmd) Output() ([]byte, error) {
 	return []byte(CmdOutput), nil
 }
 
-func (f fakeCmd) Dir(dir string) {}
+func (f *fakeCmd) Dir(dir string) {}
+
+func (f *fakeCmd) Env(env []string) {}
+
+func (f *fakeCmd) Stdin(stdin io.Reader) {}
 
-func (f fakeCmd) Stdin(stdin io.Reader) {}
+func (f *fakeCmd) Stdout(stdout io.Writer) {}
 
-func (f fakeCmd) Stdout(stdout io.Writer) {}
+func (f *fakeCmd) Stderr(stderr io.Writer) {}
 
-func (f fakeCmd) Stderr(stderr io.Writer) {}
+func (f *fakeCmd) Process() *os.Process { return nil }
 
-func (f fakeCmd) Process() *os.Process { return nil }
+func (f *fakeCmd) ProcessGroup() {}
+
+func (f *fakeCmd) Kill() error {
+	if f.process != nil {
+		f.process.kill()
+	}
+	return nil
+}
 
 // fakeInfo is a mock os.FileInfo.
 type fakeInfo struct {
@@ -178,11 +391,32 @@ func (f fakeOS) Remove(name string) error {
 	return nil
 }
 
+func (f fakeOS) RemoveAll(path string) error {
+	return nil
+}
+
+func (f fakeOS) Rename(oldpath, newpath string) error {
+	return nil
+}
+
+func (f fakeOS) Readlink(name string) (string, error) {
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+}
+
+func (f fakeOS) Symlink(oldname, newname string) error {
+	return nil
+}
+
 func (f fakeOS) LookPath(file string) (string, error) {
 	return "/usr/bin/" + file, nil
 }
 
 func (f fakeOS) TempFile(dir, prefix string) (gitos.File, error) {
+	readOnly.Lock()
+	defer readOnly.Unlock()
+	if readOnly.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, prefix), Err: os.ErrPermission}
+	}
 	return &fakeFile{name: TempFileName, info: fakeInfo{name: TempFileName}}, nil
 }
 
@@ -191,17 +425,48 @@ func (f fakeOS) TempDir() string {
 }
 
 func (f fakeOS) ReadDir(dirname string) ([]os.FileInfo, error) {
-	if f, ok := dirs[dirname]; ok {
+	dirs.Lock()
+	defer dirs.Unlock()
+	if f, ok := dirs.entries[dirname]; ok {
 		return f, nil
 	}
 	return nil, nil
 }
 
+func (f fakeOS) ReadFile(name string) ([]byte, error) {
+	files.Lock()
+	defer files.Unlock()
+	data, ok := files.data[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (f fakeOS) OpenFile(name string, flag int, perm os.FileMode) (gitos.File, error) {
+	files.Lock()
+	if _, ok := files.data[name]; !ok || flag&os.O_TRUNC != 0 {
+		files.data[name] = nil
+	}
+	files.Unlock()
+	return &openedFile{fakeFile{name: name, info: fakeInfo{name: name}}}, nil
+}
+
+func (f fakeOS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	files.Lock()
+	files.data[name] = append([]byte(nil), data...)
+	files.Unlock()
+	return nil
+}
+
 func (f fakeOS) Command(name string, args ...string) gitos.Cmd {
-	return fakeCmd{}
+	return &fakeCmd{name: name}
 }
 
 func (f fakeOS) Sleep(d time.Duration) {
+	sleeps.Lock()
+	sleeps.d = append(sleeps.d, d)
+	sleeps.Unlock()
 	time.Sleep(d / time.Duration(TimeSpeed))
 }
 
@@ -212,3 +477,24 @@ func (f fakeOS) NewTicker(d time.Duration) gitos.Ticker {
 func (f fakeOS) TimeSince(t time.Time) time.Duration {
 	return time.Since(t) * time.Duration(TimeSpeed)
 }
+
+func (f fakeOS) Int63n(n int64) int64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.Int63n(n)
+}
+
+func (f fakeOS) LockFile(name string) (func() error, error) {
+	locks.Lock()
+	defer locks.Unlock()
+	if locks.held[name] {
+		return nil, gitos.ErrLocked
+	}
+	locks.held[name] = true
+	return func() error {
+		locks.Lock()
+		delete(locks.held, name)
+		locks.Unlock()
+		return nil
+	}, nil
+}
@@ -4,5 +4,8 @@ go 1.12
 
 require (
 	github.com/caddyserver/caddy v1.0.3
+	github.com/prometheus/client_golang v1.1.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	gopkg.in/src-d/go-billy.v4 v4.2.1
 	gopkg.in/src-d/go-git.v4 v4.11.0
 )
@@ -1,24 +1,39 @@
 package git
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
-// GogsHook is the webhook for gogs.io.
+// GogsHook is the webhook for gogs.io and gitea.io.
 type GogsHook struct{}
 
 type gsPush struct {
 	Ref string `json:"ref"`
 }
 
+// gsHeader returns the value of the Gitea or Gogs header with the
+// given suffix e.g. Event for X-Gitea-Event. Gitea sends both headers.
+func gsHeader(h http.Header, suffix string) string {
+	if v := h.Get("X-Gitea-" + suffix); v != "" {
+		return v
+	}
+	return h.Get("X-Gogs-" + suffix)
+}
+
+// RequiresSecret satisfies hookHandler.
+func (g GogsHook) RequiresSecret() bool {
+	return true
+}
+
 // DoesHandle satisfies hookHandler.
 func (g GogsHook) DoesHandle(h http.Header) bool {
-	event := h.Get("X-Gogs-Event")
+	event := gsHeader(h, "Event")
 
 	// for Gogs you can only use X-Gogs-Event header to test if you could handle the request
 	if event != "" {
@@ -40,7 +55,12 @@ func (g GogsHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (in
 		return http.StatusBadRequest, err
 	}
 
-	event := r.Header.Get("X-Gogs-Event")
+	err = g.handleSignature(r, body, repo.Hook.Secret)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+
+	event := gsHeader(r.Header, "Event")
 	if event == "" {
 		return http.StatusBadRequest, errors.New("the 'X-Gogs-Event' header is required but was missing")
 	}
@@ -49,10 +69,7 @@ func (g GogsHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (in
 	case "ping":
 		w.Write([]byte("pong"))
 	case "push":
-		err = g.handlePush(body, repo)
-		if !hookIgnored(err) && err != nil {
-			return http.StatusBadRequest, err
-		}
+		return hookStatus(g.handlePush(body, repo))
 
 	// return 400 if we do not handle the event type.
 	// This is to visually show the user a configuration error in the Gogs ui.
@@ -60,31 +77,45 @@ func (g GogsHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (in
 		return http.StatusBadRequest, nil
 	}
 
-	return http.StatusOK, err
+	return http.StatusOK, nil
 }
 
-func (g GogsHook) handlePush(body []byte, repo *Repo) error {
-	var push gsPush
+// handleSignature verifies the HMAC-SHA256 signature of the body
+// if a secret is set, in which case the signature is required.
+func (g GogsHook) handleSignature(r *http.Request, body []byte, secret string) error {
+	signature := gsHeader(r.Header, "Signature")
+	if secret == "" {
+		if signature != "" {
+			Logger().Print("Unable to verify request signature. Secret not set in caddyfile!\n")
+		}
+		return nil
+	}
 
-	err := json.Unmarshal(body, &push)
-	if err != nil {
-		return err
+	if signature == "" {
+		return errors.New("the 'X-Gitea-Signature' header is required but was missing")
 	}
 
-	// extract the branch being pushed from the ref string
-	// and if it matches with our locally tracked one, pull.
-	refSlice := strings.Split(push.Ref, "/")
-	if len(refSlice) != 3 {
-		return errors.New("the push request contained an invalid reference string")
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("could not verify request signature. The signature is invalid")
 	}
 
-	branch := refSlice[2]
-	if branch != repo.Branch {
-		return hookIgnoredError{hookType: hookName(g), err: fmt.Errorf("found different branch %v", branch)}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(actual, mac.Sum(nil)) {
+		return errors.New("could not verify request signature. The signature is invalid")
 	}
+	return nil
+}
 
-	Logger().Print("Received pull notification for the tracking branch, updating...\n")
-	repo.Pull()
+func (g GogsHook) handlePush(body []byte, repo *Repo) error {
+	var push gsPush
 
-	return nil
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return err
+	}
+
+	// pull if the pushed branch or tag is one pulled by repo
+	return pullPushedRef(g, repo, push.Ref)
 }
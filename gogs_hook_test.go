@@ -2,6 +2,9 @@ package git
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -48,6 +51,74 @@ func TestGogsDeployPush(t *testing.T) {
 
 }
 
+func TestGiteaSignature(t *testing.T) {
+	repo := pulledRepo(HookConfig{URL: "/gitea_deploy", Secret: "supersecret"})
+	gsHook := GogsHook{}
+
+	sign := func(body, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for i, test := range []struct {
+		body      string
+		signature string
+		code      int
+		ignored   bool
+	}{
+		{pushGiteaBody, sign(pushGiteaBody, "supersecret"), 200, false},
+		{pushGiteaBody, sign(pushGiteaBody, "wrongsecret"), 403, false},
+		{pushGiteaBody, "not hex", 403, false},
+		{pushGiteaBody, "", 403, false},
+		{pushGSBodyOther, sign(pushGSBodyOther, "supersecret"), 200, true},
+	} {
+		req, err := http.NewRequest("POST", "/gitea_deploy", bytes.NewBuffer([]byte(test.body)))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Add("X-Gitea-Event", "push")
+		if test.signature != "" {
+			req.Header.Add("X-Gitea-Signature", test.signature)
+		}
+
+		if !gsHook.DoesHandle(req.Header) {
+			t.Errorf("Test %d: Expected Gitea request to be handled", i)
+		}
+
+		code, err := gsHook.Handle(httptest.NewRecorder(), req, repo)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+		if hookIgnored(err) != test.ignored {
+			t.Errorf("Test %d: Expected webhook ignored to be %v but found error %v", i, test.ignored, err)
+		}
+	}
+}
+
+var pushGiteaBody = `
+{
+  "secret": "",
+  "ref": "refs/heads/master",
+  "before": "28e1879d029cb852e4844d9c718537df08844e03",
+  "after": "bffeb74224043ba2feb48d137756c8a9331c449a",
+  "compare_url": "http://localhost:3000/gitea/webhooks/compare/28e1879d029cb852e4844d9c718537df08844e03...bffeb74224043ba2feb48d137756c8a9331c449a",
+  "commits": [
+    {
+      "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+      "message": "Webhooks Yay!",
+      "url": "http://localhost:3000/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a"
+    }
+  ],
+  "repository": {
+    "id": 140,
+    "name": "webhooks",
+    "full_name": "gitea/webhooks",
+    "default_branch": "master"
+  }
+}
+`
+
 var pushGSBodyPartial = `
 {
   "ref": ""
@@ -0,0 +1,71 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// staleIntervals is the number of intervals after which a repository
+// which didn't pull successfully is reported unhealthy.
+const staleIntervals = 2
+
+// health returns why r is unhealthy: its last pull failed, or its last
+// successful pull is older than staleIntervals of its interval. Repos
+// pulled by webhooks are never stale. An empty string is returned if
+// r is healthy.
+func (r *Repo) health(now time.Time) string {
+	status := r.Status()
+	if status.Failed {
+		return "last pull failed: " + status.Error
+	}
+	// repos without periodic pulls, or not pulled yet, can't be stale
+	if r.Interval <= 0 || r.Hook.URL != "" || status.LastPull.IsZero() {
+		return ""
+	}
+	if age := now.Sub(status.LastPull); age > staleIntervals*r.Interval {
+		return fmt.Sprintf("last pull %v ago", age.Round(time.Second))
+	}
+	return ""
+}
+
+// HealthHandler is middleware serving the health of repos, e.g. for
+// liveness probes. It responds with status 503 if any of the repos
+// is unhealthy.
+type HealthHandler struct {
+	Path  string
+	Repos []*Repo
+	Next  httpserver.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (h HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != h.Path {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	var unhealthy []string
+	now := time.Now()
+	for _, repo := range h.Repos {
+		if reason := repo.health(now); reason != "" {
+			unhealthy = append(unhealthy, fmt.Sprintf("%v: %v", repo.redact(repo.publicName()), reason))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(unhealthy) == 0 {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "OK")
+		return http.StatusOK, nil
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, line := range unhealthy {
+		fmt.Fprintln(w, line)
+	}
+	return http.StatusServiceUnavailable, nil
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestHealthHandler(t *testing.T) {
+	// repo returns a repo last pulled ago, with the pull error err
+	repo := func(interval, ago time.Duration, err error) *Repo {
+		r := &Repo{URL: "https://github.com/user/repo.git", Branch: "master", Interval: interval}
+		if ago >= 0 {
+			r.lastPull = time.Now().Add(-ago)
+		}
+		r.setStatus(err)
+		return r
+	}
+
+	// hookRepo configures r to be pulled by webhooks
+	hookRepo := func(r *Repo) *Repo {
+		r.Hook.URL = "/webhook"
+		return r
+	}
+
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+
+	tests := []struct {
+		repos  []*Repo
+		code   int
+		reason string
+	}{
+		{[]*Repo{repo(time.Hour, time.Minute, nil)}, http.StatusOK, ""},
+		// not pulled yet
+		{[]*Repo{repo(time.Hour, -1, nil)}, http.StatusOK, ""},
+		// no periodic pulls
+		{[]*Repo{repo(-1, 24*time.Hour, nil)}, http.StatusOK, ""},
+		{[]*Repo{hookRepo(repo(time.Hour, 24*time.Hour, nil))}, http.StatusOK, ""},
+		{[]*Repo{repo(time.Hour, time.Minute, nil), repo(time.Hour, 3*time.Hour, nil)}, http.StatusServiceUnavailable, "last pull 3h0m0s ago"},
+		{[]*Repo{repo(time.Hour, time.Minute, errors.New("remote unreachable"))}, http.StatusServiceUnavailable, "remote unreachable"},
+		{[]*Repo{repo(time.Hour, -1, errors.New("remote unreachable"))}, http.StatusServiceUnavailable, "remote unreachable"},
+	}
+
+	for i, test := range tests {
+		health := HealthHandler{Path: "/health", Repos: test.repos, Next: next}
+
+		req, err := http.NewRequest("GET", "/other", nil)
+		check(t, err)
+		if code, _ := health.ServeHTTP(httptest.NewRecorder(), req); code != http.StatusNotFound {
+			t.Errorf("Test %v expected other paths to be passed to the next handler, found status %v", i, code)
+		}
+
+		req, err = http.NewRequest("GET", "/health", nil)
+		check(t, err)
+		rec := httptest.NewRecorder()
+		code, err := health.ServeHTTP(rec, req)
+		check(t, err)
+		if code != test.code || rec.Code != test.code {
+			t.Errorf("Test %v expected status %v found %v", i, test.code, code)
+		}
+		if test.reason != "" && !strings.Contains(rec.Body.String(), test.reason) {
+			t.Errorf("Test %v expected %q in the response, found %q", i, test.reason, rec.Body.String())
+		}
+	}
+}
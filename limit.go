@@ -0,0 +1,85 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// pullSlots limits the number of clones and pulls running at once.
+// slots is nil if there is no limit.
+var pullSlots struct {
+	slots chan struct{}
+	sync.Mutex
+}
+
+// SetMaxConcurrentClones limits the number of clones and pulls of all
+// the repositories running at once to n, the others waiting for their
+// turn. There is no limit if n < 1.
+func SetMaxConcurrentClones(n int) {
+	pullSlots.Lock()
+	defer pullSlots.Unlock()
+	if n < 1 {
+		pullSlots.slots = nil
+		return
+	}
+	if pullSlots.slots == nil || cap(pullSlots.slots) != n {
+		pullSlots.slots = make(chan struct{}, n)
+	}
+}
+
+// instanceMaxClones holds the limits of concurrent clones set by each
+// Caddy instance. The limit of the instance set up last is in use: a
+// reload replaces it, none if the new configuration has none.
+var instanceMaxClones = struct {
+	limits map[interface{}]int
+	sync.Mutex
+}{limits: make(map[interface{}]int)}
+
+// useInstanceMaxClones switches to the limit set by instance with
+// setInstanceMaxClones, none if it has not set one.
+func useInstanceMaxClones(instance interface{}) {
+	instanceMaxClones.Lock()
+	n := instanceMaxClones.limits[instance]
+	instanceMaxClones.Unlock()
+	SetMaxConcurrentClones(n)
+}
+
+// setInstanceMaxClones sets the limit of instance to n and uses it. It
+// fails if another server block of instance set another limit.
+func setInstanceMaxClones(instance interface{}, n int) error {
+	instanceMaxClones.Lock()
+	if m, ok := instanceMaxClones.limits[instance]; ok && m != n {
+		instanceMaxClones.Unlock()
+		return fmt.Errorf("conflicting max_concurrent_clones %v and %v", m, n)
+	}
+	instanceMaxClones.limits[instance] = n
+	instanceMaxClones.Unlock()
+	SetMaxConcurrentClones(n)
+	return nil
+}
+
+// removeInstanceMaxClones removes the limit of instance, e.g. on shutdown.
+func removeInstanceMaxClones(instance interface{}) {
+	instanceMaxClones.Lock()
+	delete(instanceMaxClones.limits, instance)
+	instanceMaxClones.Unlock()
+}
+
+// acquirePullSlot waits until a pull may run, or ctx is done.
+// The returned function releases the slot once the pull is over.
+func acquirePullSlot(ctx context.Context) (func(), error) {
+	pullSlots.Lock()
+	slots := pullSlots.slots
+	pullSlots.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
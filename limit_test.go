@@ -0,0 +1,110 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestMaxConcurrentClones(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	SetMaxConcurrentClones(1)
+	defer SetMaxConcurrentClones(0)
+	atomic.StoreInt32(&blockingUploads, 0)
+
+	// clones block until cancelled
+	var repos []*Repo
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repo := &Repo{URL: RepoURL(fmt.Sprintf("blocking://example.com/user/repo%v.git", i)), Path: dir, Branch: "master"}
+		repos = append(repos, repo)
+		go func() {
+			repo.Pull()
+			done <- struct{}{}
+		}()
+		time.Sleep(time.Second / 5)
+	}
+
+	if n := atomic.LoadInt32(&blockingUploads); n != 1 {
+		t.Fatalf("Expected a single clone running found %v", n)
+	}
+
+	// the waiting clone starts once the running one is over
+	repos[0].Cancel()
+	<-done
+	time.Sleep(time.Second / 5)
+	if n := atomic.LoadInt32(&blockingUploads); n != 2 {
+		t.Errorf("Expected the second clone to run found %v clones", n)
+	}
+	repos[1].Cancel()
+	<-done
+}
+
+func TestAcquirePullSlot(t *testing.T) {
+	SetMaxConcurrentClones(2)
+	defer SetMaxConcurrentClones(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := acquirePullSlot(ctx)
+		check(t, err)
+		releases = append(releases, release)
+	}
+
+	cancel()
+	if _, err := acquirePullSlot(ctx); err != context.Canceled {
+		t.Errorf("Expected %v found %v", context.Canceled, err)
+	}
+
+	releases[0]()
+	release, err := acquirePullSlot(context.Background())
+	check(t, err)
+	release()
+	releases[1]()
+}
+
+func TestInstanceMaxClones(t *testing.T) {
+	defer SetMaxConcurrentClones(0)
+
+	// limit returns the limit in use, 0 for none
+	limit := func() int {
+		pullSlots.Lock()
+		defer pullSlots.Unlock()
+		return cap(pullSlots.slots)
+	}
+
+	old, reloaded := new(int), new(int)
+	defer removeInstanceMaxClones(old)
+	defer removeInstanceMaxClones(reloaded)
+
+	useInstanceMaxClones(old)
+	check(t, setInstanceMaxClones(old, 2))
+	if err := setInstanceMaxClones(old, 3); err == nil {
+		t.Errorf("Expected error for conflicting limits of an instance but found nil")
+	}
+	if n := limit(); n != 2 {
+		t.Errorf("Expected limit 2 found %v", n)
+	}
+
+	// a reload without max_concurrent_clones removes the limit
+	useInstanceMaxClones(reloaded)
+	if n := limit(); n != 0 {
+		t.Errorf("Expected no limit after reload found %v", n)
+	}
+
+	// the limit is restored if the reload fails
+	useInstanceMaxClones(old)
+	if n := limit(); n != 2 {
+		t.Errorf("Expected limit 2 restored found %v", n)
+	}
+}
@@ -1,20 +1,32 @@
 package git
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // logger is used to log errors
-var logger = &gitLogger{l: log.New(os.Stderr, "", log.LstdFlags)}
+var logger = newGitLogger(log.New(os.Stderr, "", log.LstdFlags))
 
 // gitLogger wraps log.Logger with mutex for thread safety.
 type gitLogger struct {
-	l *log.Logger
+	l    *log.Logger
+	base *log.Logger // logger set by SetLogger, restored by installLogger
 	sync.RWMutex
 }
 
+// newGitLogger creates a gitLogger logging to l.
+func newGitLogger(l *log.Logger) *gitLogger {
+	return &gitLogger{l: l, base: l}
+}
+
 func (g *gitLogger) logger() *log.Logger {
 	g.RLock()
 	defer g.RUnlock()
@@ -22,9 +34,32 @@ func (g *gitLogger) logger() *log.Logger {
 }
 
 func (g *gitLogger) setLogger(l *log.Logger) {
+	g.Lock()
+	g.l, g.base = l, l
+	g.Unlock()
+}
+
+// baseLogger returns the logger set by SetLogger.
+func (g *gitLogger) baseLogger() *log.Logger {
+	g.RLock()
+	defer g.RUnlock()
+	return g.base
+}
+
+// install sets l as the current logger. The returned function restores
+// the logger set by SetLogger, unless l was replaced since e.g. by the
+// logger of a new Caddy instance. It can be called several times.
+func (g *gitLogger) install(l *log.Logger) func() {
 	g.Lock()
 	g.l = l
 	g.Unlock()
+	return func() {
+		g.Lock()
+		if g.l == l {
+			g.l = g.base
+		}
+		g.Unlock()
+	}
 }
 
 // Logger gets the currently available logger
@@ -36,3 +71,152 @@ func Logger() *log.Logger {
 func SetLogger(l *log.Logger) {
 	logger.setLogger(l)
 }
+
+// logCreds is 1 if the credentials of the urls are logged,
+// accessed atomically.
+var logCreds int32
+
+// SetLogCredentials enables logging the urls of the repos with their
+// credentials, for debugging authentication. DANGEROUS: the passwords
+// and tokens of the urls are written to the logs in clear text, never
+// enable it outside of development. Disabled by default.
+func SetLogCredentials(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&logCreds, v)
+}
+
+// logCredentials checks if SetLogCredentials enabled
+// logging the credentials of the urls.
+func logCredentials() bool {
+	return atomic.LoadInt32(&logCreds) == 1
+}
+
+// openLog appends the logs to the file name, or to the logger set by
+// SetLogger if name is empty, as JSON entries if jsonFormat is set. The
+// returned function closes the file and restores the logger set by
+// SetLogger, unless another log was opened since. It can be called
+// several times.
+func openLog(name string, jsonFormat bool) (func() error, error) {
+	w := logger.baseLogger().Writer()
+	closeFile := func() error { return nil }
+	if name != "" {
+		f, err := gos.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0644))
+		if err != nil {
+			return nil, err
+		}
+		w, closeFile = f, f.Close
+	}
+
+	l := log.New(w, "", log.LstdFlags)
+	if jsonFormat {
+		l = log.New(&jsonLogWriter{w: w}, "", 0)
+	}
+	restore := logger.install(l)
+
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			restore()
+			err = closeFile()
+		})
+		return err
+	}, nil
+}
+
+// LogLevel is the verbosity of the logs of a repo.
+// The errors are logged at all levels.
+type LogLevel int
+
+const (
+	// LogQuiet omits the routine pulls without changes.
+	LogQuiet LogLevel = iota - 1
+
+	// LogNormal logs each pull.
+	LogNormal
+
+	// LogVerbose adds the details of the fetches and checkouts.
+	LogVerbose
+)
+
+// parseLogLevel parses the name of a log level.
+func parseLogLevel(name string) (LogLevel, bool) {
+	switch name {
+	case "quiet":
+		return LogQuiet, true
+	case "normal":
+		return LogNormal, true
+	case "verbose":
+		return LogVerbose, true
+	}
+	return LogNormal, false
+}
+
+// logf logs like Logger().Printf if the log level of r is at least level.
+func (r *Repo) logf(level LogLevel, format string, v ...interface{}) {
+	r.logEvent(level, "", "", nil, format, v...)
+}
+
+// logEvent logs the event of r like logf. In JSON format, the entry
+// has the event, commit and err fields if they are set.
+func (r *Repo) logEvent(level LogLevel, event, commit string, err error, format string, v ...interface{}) {
+	if r.LogLevel < level {
+		return
+	}
+	l := Logger()
+	w, ok := l.Writer().(*jsonLogWriter)
+	if !ok {
+		l.Printf(format, v...)
+		return
+	}
+	entry := logEntry{
+		Repo:    r.label(),
+		Event:   event,
+		Commit:  commit,
+		Message: strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	w.writeEntry(entry)
+}
+
+// logEntry is a log line in JSON format.
+type logEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Repo      string    `json:"repo,omitempty"`
+	Event     string    `json:"event,omitempty"`
+	Commit    string    `json:"commit,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// jsonLogWriter writes the lines of a logger as JSON entries,
+// one per line, along with the entries of logEvent.
+type jsonLogWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// Write writes the line p as the message of a JSON entry.
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	j.writeEntry(logEntry{Message: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+// writeEntry writes entry, timestamped now, as a line of JSON.
+func (j *jsonLogWriter) writeEntry(entry logEntry) {
+	entry.Timestamp = time.Now().UTC()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// the entries can always be encoded, only writing may fail
+	json.NewEncoder(j.w).Encode(entry)
+}
+
+// isLogFormat checks if format is a supported log format.
+func isLogFormat(format string) bool {
+	return format == "text" || format == "json"
+}
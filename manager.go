@@ -0,0 +1,161 @@
+package git
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RepoOptions are the options of a repo created with NewRepo, for
+// embedding the package without a Caddyfile. The zero values default
+// like the directives of the same name. The other settings are set on
+// the fields of the returned Repo.
+type RepoOptions struct {
+	URL         string        // Repository URL, scp-like urls are accepted
+	Path        string        // Directory to pull to
+	Branch      string        // Git branch, master by default
+	Remote      string        // Name of the remote, origin by default
+	Interval    time.Duration // Interval between pulls, DefaultInterval by default, negative to disable them
+	MinInterval time.Duration // Minimum time between two pulls, DefaultMinInterval by default, negative for none
+	KeyPath     string        // Path to the private key of ssh urls
+	User        string        // Username of http urls
+	Password    string        // Password of http urls
+	Token       string        // Authentication token of http urls
+	Then        []Then        // Commands to execute after each pull changing the commit
+}
+
+// NewRepo creates the repo configured by opts and prepares its path.
+func NewRepo(opts RepoOptions) (*Repo, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("path of %v is missing", opts.URL)
+	}
+	repoURL, u, err := parseURL(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &Repo{
+		URL:            repoURL,
+		Host:           u.Hostname(),
+		Path:           filepath.Clean(opts.Path),
+		Branch:         opts.Branch,
+		Remote:         opts.Remote,
+		Interval:       opts.Interval,
+		MinInterval:    opts.MinInterval,
+		KeyPath:        opts.KeyPath,
+		User:           opts.User,
+		Password:       opts.Password,
+		Token:          opts.Token,
+		Then:           opts.Then,
+		SubmoduleDepth: defaultSubmoduleDepth,
+		Retries:        numRetries,
+		RetryBackoff:   DefaultRetryBackoff,
+	}
+	if repo.Branch == "" {
+		repo.Branch = "master"
+	}
+	if repo.Remote == "" {
+		repo.Remote = "origin"
+	}
+	if repo.Interval == 0 {
+		repo.Interval = DefaultInterval
+	}
+	if repo.MinInterval == 0 {
+		repo.MinInterval = DefaultMinInterval
+	}
+
+	if err := repo.Prepare(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Manager owns a set of repos and runs their periodic pulls,
+// as the Caddy plugin does for the repos of a Caddyfile.
+type Manager struct {
+	repos Git
+	sync.Mutex
+}
+
+// NewManager creates a manager of repos.
+func NewManager(repos ...*Repo) *Manager {
+	return &Manager{repos: repos}
+}
+
+// Add adds repo to the repos of m. Repos added after
+// Start are not started.
+func (m *Manager) Add(repo *Repo) {
+	m.Lock()
+	m.repos = append(m.repos, repo)
+	m.Unlock()
+}
+
+// Repos returns the repos of m.
+func (m *Manager) Repos() Git {
+	m.Lock()
+	defer m.Unlock()
+	return append(Git(nil), m.repos...)
+}
+
+// Start starts the periodic pulls of the repos of m, except the
+// repos pulled by webhooks, and pulls them unless they skip the
+// startup pull. The errors of the pulls are returned together.
+func (m *Manager) Start() error {
+	var errs []error
+	for _, repo := range m.Repos() {
+		errs = append(errs, startup(repo)())
+	}
+	return mergeErrors(errs...)
+}
+
+// PullAll pulls the repos of m concurrently, and returns
+// the errors of the pulls together.
+func (m *Manager) PullAll() error {
+	repos := m.Repos()
+	errs := make([]error, len(repos))
+
+	var wg sync.WaitGroup
+	for i, repo := range repos {
+		wg.Add(1)
+		go func(i int, repo *Repo) {
+			defer wg.Done()
+			errs[i] = repo.Pull()
+		}(i, repo)
+	}
+	wg.Wait()
+	return mergeErrors(errs...)
+}
+
+// Pause stops the periodic pulls of the repos of m and aborts the
+// running pulls, until Resume.
+func (m *Manager) Pause() {
+	for _, repo := range m.Repos() {
+		Stop(repo)
+		repo.Cancel()
+	}
+}
+
+// Resume starts again the periodic pulls of the repos of m stopped by
+// Pause, except the repos pulled by webhooks. The repos are not pulled
+// right away.
+func (m *Manager) Resume() {
+	for _, repo := range m.Repos() {
+		if repo.Hook.URL == "" {
+			Start(repo)
+		}
+	}
+}
+
+// Stop stops the periodic pulls of the repos of m, aborts the running
+// pulls, cancels the delayed then commands and kills the then_long
+// commands. The repos can still be pulled, e.g. by webhooks, and
+// Start starts their periodic pulls again.
+func (m *Manager) Stop() {
+	for _, repo := range m.Repos() {
+		Stop(repo)
+		repo.Cancel()
+		repo.stopDebounce()
+		repo.stopThen()
+	}
+}
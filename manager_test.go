@@ -0,0 +1,119 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestNewRepo(t *testing.T) {
+	tests := []struct {
+		opts      RepoOptions
+		shouldErr bool
+		expected  *Repo
+	}{
+		{RepoOptions{URL: "github.com/user/repo", Path: "/var/www/"}, false, &Repo{
+			URL:         "https://github.com/user/repo",
+			Host:        "github.com",
+			Path:        "/var/www",
+			Branch:      "master",
+			Remote:      "origin",
+			Interval:    DefaultInterval,
+			MinInterval: DefaultMinInterval,
+			Retries:     numRetries,
+		}},
+		{RepoOptions{URL: "git@github.com:user/repo", Path: "/var/www", Branch: "gh-pages", Interval: -1}, false, &Repo{
+			URL:      "ssh://git@github.com:user/repo",
+			Branch:   "gh-pages",
+			Interval: -1,
+		}},
+		{RepoOptions{URL: "github.com/user/repo"}, true, nil},
+		{RepoOptions{URL: "foo://github.com/user/repo", Path: "/var/www"}, true, nil},
+	}
+
+	for i, test := range tests {
+		repo, err := NewRepo(test.opts)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+			continue
+		}
+		if !reposEqual(test.expected, repo) {
+			t.Errorf("Test %v: expected %#v found %#v", i, test.expected, repo)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	var repos []*Repo
+	var remotes []*testRemote
+	for i := 0; i < 2; i++ {
+		remote := newRemote(t)
+		defer os.RemoveAll(remote.dir)
+		remote.commit(t, "index.html", "first")
+		remotes = append(remotes, remote)
+
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repo, err := NewRepo(RepoOptions{
+			URL:         "file://" + filepath.ToSlash(string(remote.URL())),
+			Path:        dir,
+			MinInterval: -1,
+		})
+		check(t, err)
+		repos = append(repos, repo)
+	}
+
+	manager := NewManager(repos[0])
+	manager.Add(repos[1])
+	check(t, manager.Start())
+	for i, repo := range repos {
+		if !repo.pulled {
+			t.Errorf("Expected repo %v pulled at start", i)
+		}
+	}
+	if n := countServices(repos); n != 2 {
+		t.Errorf("Expected 2 services found %v", n)
+	}
+
+	second := remotes[1].commit(t, "index.html", "second")
+	check(t, manager.PullAll())
+	if repos[1].lastCommit != second {
+		t.Errorf("Expected commit %v pulled found %v", second, repos[1].lastCommit)
+	}
+
+	manager.Pause()
+	if n := countServices(repos); n != 0 {
+		t.Errorf("Expected services paused found %v", n)
+	}
+	manager.Resume()
+	if n := countServices(repos); n != 2 {
+		t.Errorf("Expected 2 services resumed found %v", n)
+	}
+
+	manager.Stop()
+	if n := countServices(repos); n != 0 {
+		t.Errorf("Expected services stopped found %v", n)
+	}
+	// the repos can still be pulled e.g. by webhooks
+	check(t, manager.PullAll())
+}
+
+// countServices returns the number of running services of repos.
+func countServices(repos []*Repo) int {
+	Services.Lock()
+	defer Services.Unlock()
+	var n int
+	for _, s := range Services.services {
+		for _, repo := range repos {
+			if s.repo == repo {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,76 @@
+package git
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of pulls. They are only registered
+// if a repo enables metrics.
+var (
+	pullsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddygit",
+		Name:      "pulls_total",
+		Help:      "Number of pulls by repository and result.",
+	}, []string{"repo", "result"})
+
+	lastPullTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddygit",
+		Name:      "last_pull_timestamp",
+		Help:      "Unix time of the last successful pull by repository.",
+	}, []string{"repo"})
+
+	pullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddygit",
+		Name:      "pull_duration_seconds",
+		Help:      "Duration of pulls by repository.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repo"})
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the metrics of pulls
+// with the default prometheus registry.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(pullsTotal, lastPullTimestamp, pullDuration)
+	})
+}
+
+// observePull updates the metrics of r for a pull started
+// at start which returned err.
+func (r *Repo) observePull(start time.Time, err error) {
+	if !r.Metrics {
+		return
+	}
+
+	repo := r.name()
+	pullDuration.WithLabelValues(repo).Observe(time.Since(start).Seconds())
+	if err != nil {
+		pullsTotal.WithLabelValues(repo, "failure").Inc()
+		return
+	}
+	pullsTotal.WithLabelValues(repo, "success").Inc()
+	lastPullTimestamp.WithLabelValues(repo).Set(float64(r.lastPull.Unix()))
+}
+
+// MetricsHandler is middleware serving the prometheus metrics.
+type MetricsHandler struct {
+	Path string
+	Next httpserver.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (h MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != h.Path {
+		return h.Next.ServeHTTP(w, r)
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+	return http.StatusOK, nil
+}
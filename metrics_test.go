@@ -0,0 +1,43 @@
+package git
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := &Repo{URL: remote.URL(), Path: dir, Branch: "master", Metrics: true}
+	label := repo.URL.String()
+
+	check(t, repo.Pull())
+	if n := testutil.ToFloat64(pullsTotal.WithLabelValues(label, "success")); n != 1 {
+		t.Errorf("Expected 1 successful pull found %v", n)
+	}
+	if ts := testutil.ToFloat64(lastPullTimestamp.WithLabelValues(label)); ts != float64(repo.lastPull.Unix()) {
+		t.Errorf("Expected last pull timestamp %v found %v", repo.lastPull.Unix(), ts)
+	}
+
+	repo.Branch = "missing"
+	if err := repo.Pull(); err == nil {
+		t.Fatalf("Expected pull of missing branch to fail")
+	}
+	if n := testutil.ToFloat64(pullsTotal.WithLabelValues(label, "failure")); n != 1 {
+		t.Errorf("Expected 1 failed pull found %v", n)
+	}
+
+	// disabled metrics are not recorded
+	other := &Repo{URL: remote.URL() + ".other", Path: dir, Branch: "missing"}
+	other.Pull()
+	if n := testutil.ToFloat64(pullsTotal.WithLabelValues(other.URL.String(), "failure")); n != 0 {
+		t.Errorf("Expected no recorded pulls found %v", n)
+	}
+}
@@ -0,0 +1,68 @@
+package git
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// mirrorRefSpec fetches all the references of the remote
+// repository into the same references of the mirror.
+const mirrorRefSpec = config.RefSpec("+refs/*:refs/*")
+
+// mirror updates the bare mirror of the remote repository at r.Path
+// with all its branches and tags, cloning it if it does not exist.
+// The head of r.Branch is recorded as the most recent commit.
+func (r *Repo) mirror(ctx context.Context) error {
+	auth, err := r.auth()
+	if err != nil {
+		return err
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	switch err {
+	case nil:
+	case git.ErrRepositoryNotExists:
+		gr, err = git.PlainCloneContext(ctx, r.Path, true, &git.CloneOptions{
+			URL:        r.pullURL().Val(),
+			Auth:       auth,
+			RemoteName: r.remoteName(),
+			Tags:       git.AllTags,
+			Progress:   r.progress(),
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	err = gr.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: r.remoteName(),
+		RefSpecs:   []config.RefSpec{mirrorRefSpec},
+		Auth:       auth,
+		Tags:       git.AllTags,
+		Progress:   r.progress(),
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	r.pulled = true
+	r.lastPull = time.Now()
+	r.logf(LogNormal, "%v mirrored.\n", r.label())
+
+	ref, err := gr.Reference(plumbing.NewBranchReferenceName(r.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		// the branch is not required to mirror the repository
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.lastCommit = ref.Hash().String()
+	return nil
+}
@@ -0,0 +1,78 @@
+package git
+
+import (
+	"os"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestMirror(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	master := remote.commit(t, "index.html", "master")
+	_, err := remote.repo.CreateTag("v1.0.0", plumbing.NewHash(master), nil)
+	check(t, err)
+	remote.checkout(t, "develop")
+	develop := remote.commit(t, "index.html", "develop")
+	remote.checkout(t, "master")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	then := &countThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Mirror: true, Then: []Then{then}})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	if _, err := gr.Worktree(); err != gogit.ErrIsBareRepository {
+		t.Errorf("Expected a bare repository found %v", err)
+	}
+
+	refs := func() map[plumbing.ReferenceName]string {
+		refs := make(map[plumbing.ReferenceName]string)
+		for _, name := range []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName("master"),
+			plumbing.NewBranchReferenceName("develop"),
+			plumbing.NewTagReferenceName("v1.0.0"),
+		} {
+			if ref, err := gr.Reference(name, false); err == nil {
+				refs[name] = ref.Hash().String()
+			}
+		}
+		return refs
+	}
+	expected := map[plumbing.ReferenceName]string{
+		plumbing.NewBranchReferenceName("master"):  master,
+		plumbing.NewBranchReferenceName("develop"): develop,
+		plumbing.NewTagReferenceName("v1.0.0"):     master,
+	}
+	for name, hash := range expected {
+		if refs()[name] != hash {
+			t.Errorf("Expected %v at %v found %v", name, hash, refs()[name])
+		}
+	}
+
+	// the other branches are updated too
+	remote.checkout(t, "develop")
+	develop = remote.commit(t, "index.html", "develop 2")
+	remote.checkout(t, "master")
+	check(t, repo.Pull())
+
+	if h := refs()[plumbing.NewBranchReferenceName("develop")]; h != develop {
+		t.Errorf("Expected develop at %v found %v", develop, h)
+	}
+	if repo.lastCommit != master {
+		t.Errorf("Expected last commit %v found %v", master, repo.lastCommit)
+	}
+	if then.n != 0 {
+		t.Errorf("Expected then commands not to be executed found %v executions", then.n)
+	}
+}
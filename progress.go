@@ -0,0 +1,65 @@
+package git
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/sideband"
+)
+
+// progressInterval is the minimum time between two logged
+// updates of a progress line.
+const progressInterval = 5 * time.Second
+
+// progressLogger logs the progress of the clones and fetches
+// sent by the remote, e.g. Receiving objects: 42% (420/1000).
+type progressLogger struct {
+	repo    *Repo
+	line    []byte
+	lastLog time.Time
+}
+
+// progress returns the writer of the progress of the clones and
+// fetches of r. The progress is only logged at the verbose level.
+func (r *Repo) progress() sideband.Progress {
+	if r.LogLevel < LogVerbose {
+		return nil
+	}
+	return &progressLogger{repo: r}
+}
+
+// Write logs the complete lines of b. The remote updates a line
+// ending it with \r, the updates are logged every progressInterval.
+func (p *progressLogger) Write(b []byte) (int, error) {
+	for _, c := range b {
+		switch c {
+		case '\n':
+			p.log(true)
+		case '\r':
+			p.log(false)
+		default:
+			p.line = append(p.line, c)
+		}
+	}
+	return len(b), nil
+}
+
+// log logs the current line, unless it is an update logged
+// sooner than progressInterval after the last update.
+func (p *progressLogger) log(done bool) {
+	line := strings.TrimSpace(string(p.line))
+	p.line = p.line[:0]
+	if line == "" {
+		return
+	}
+	if !done && !p.lastLog.IsZero() && gos.TimeSince(p.lastLog) < progressInterval {
+		return
+	}
+
+	// the first update of the next line is logged right away
+	p.lastLog = time.Time{}
+	if !done {
+		p.lastLog = time.Now()
+	}
+	Logger().Printf("%v: %v\n", p.repo.label(), line)
+}
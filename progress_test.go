@@ -0,0 +1,47 @@
+package git
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestProgress(t *testing.T) {
+	repo := createRepo(nil)
+	repo.Name = "site"
+	if repo.progress() != nil {
+		t.Error("Expected no progress logged at the normal level")
+	}
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	repo.LogLevel = LogVerbose
+	progress := repo.progress()
+	for _, s := range []string{
+		"Counting objects: 10, done.\n",
+		"Receiving objects:  10% (1/10)\r",
+		"Receiving objects:  20% (2/10)\r",
+		"Receiving objects: 100% (10/10), done.\n",
+	} {
+		n, err := progress.Write([]byte(s))
+		check(t, err)
+		if n != len(s) {
+			t.Errorf("Expected %v bytes written found %v", len(s), n)
+		}
+	}
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	for _, s := range []string{"site: Counting objects: 10, done.", "site: Receiving objects:  10% (1/10)", "site: Receiving objects: 100% (10/10), done."} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("Expected %q logged found %q", s, out)
+		}
+	}
+	// the updates are throttled
+	if strings.Contains(string(out), "20%") {
+		t.Errorf("Expected update not logged found %q", out)
+	}
+}
@@ -0,0 +1,132 @@
+package git
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// proxies maps hosts to the url of the proxy used to reach them.
+var proxies = newInstanceHosts()
+
+// instanceHosts maps hosts to a setting, per Caddy instance. The settings
+// of the instance set up last are in use: a reload replaces them, and
+// the settings of the old instance are used again if the reload fails.
+type instanceHosts struct {
+	instances map[interface{}]map[string]string
+	current   interface{}
+	sync.Mutex
+}
+
+// newInstanceHosts creates an empty instanceHosts.
+func newInstanceHosts() *instanceHosts {
+	return &instanceHosts{instances: make(map[interface{}]map[string]string)}
+}
+
+// use switches to the settings of instance.
+func (h *instanceHosts) use(instance interface{}) {
+	h.Lock()
+	defer h.Unlock()
+	if h.instances[instance] == nil {
+		h.instances[instance] = make(map[string]string)
+	}
+	h.current = instance
+}
+
+// set sets the setting of host for instance. It returns
+// false if host already has another setting.
+func (h *instanceHosts) set(instance interface{}, host, value string) bool {
+	h.Lock()
+	defer h.Unlock()
+	hosts := h.instances[instance]
+	if hosts == nil {
+		hosts = make(map[string]string)
+		h.instances[instance] = hosts
+	}
+	if v, ok := hosts[host]; ok && v != value {
+		return false
+	}
+	hosts[host] = value
+	return true
+}
+
+// get returns the setting of host in use.
+func (h *instanceHosts) get(host string) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+	value, ok := h.instances[h.current][host]
+	return value, ok
+}
+
+// remove removes the settings of instance, e.g. on shutdown.
+func (h *instanceHosts) remove(instance interface{}) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.instances, instance)
+}
+
+var installHTTPClientOnce sync.Once
+
+// parseProxy parses and validates a proxy url.
+// HTTP, HTTPS and SOCKS5 proxies are supported.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host in %v", s)
+	}
+	return u, nil
+}
+
+// setProxy routes the git requests to host through proxy, once the
+// Caddy instance is in use. Credentials of the proxy url are used to
+// authenticate with the proxy.
+func setProxy(instance interface{}, host string, proxy *url.URL) error {
+	installHTTPClientOnce.Do(installHTTPClient)
+
+	if !proxies.set(instance, host, proxy.String()) {
+		return fmt.Errorf("conflicting proxies for %v", host)
+	}
+	return nil
+}
+
+// httpProxy returns the proxy to use for req: the proxy set for its host,
+// or the one of the environment e.g. HTTPS_PROXY.
+func httpProxy(req *http.Request) (*url.URL, error) {
+	if proxy, ok := proxies.get(req.URL.Hostname()); ok {
+		return url.Parse(proxy)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// installHTTPClient replaces the http client of go-git
+// with one using the configured proxies and user agents.
+func installHTTPClient() {
+	transport := &http.Transport{
+		Proxy: httpProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	c := githttp.NewClient(&http.Client{Transport: userAgentTransport{transport}})
+	client.InstallProtocol("http", c)
+	client.InstallProtocol("https", c)
+}
@@ -0,0 +1,83 @@
+package git
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// PullHandler is middleware pulling a repository on demand and
+// serving its state after the pull as JSON.
+type PullHandler struct {
+	Path  string
+	Repos []*Repo
+	Next  httpserver.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+// The repository is selected by its name or url with the repo query
+// parameter, which may be omitted if it is the only one served.
+// The request must be authorized with the pull token of the repository
+// as bearer token.
+func (h PullHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != h.Path {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	repo := h.repo(r.URL.Query().Get("repo"))
+	if repo == nil {
+		return http.StatusNotFound, nil
+	}
+	if !pullAuthorized(r, repo.PullToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return http.StatusUnauthorized, nil
+	}
+
+	Logger().Printf("Received pull request for %v, updating...\n", repo.label())
+	status := http.StatusOK
+	if err := repo.Pull(); err != nil {
+		Logger().Println(err)
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(repo.Status()); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// repo returns the repository named or with the url id,
+// or the only repository if id is empty. It returns nil
+// if there is no such repository.
+func (h PullHandler) repo(id string) *Repo {
+	if id == "" {
+		if len(h.Repos) == 1 {
+			return h.Repos[0]
+		}
+		return nil
+	}
+	for _, repo := range h.Repos {
+		if (repo.Name != "" && repo.Name == id) || repo.URL.String() == id {
+			return repo
+		}
+	}
+	return nil
+}
+
+// pullAuthorized checks if the bearer token of r is token.
+func pullAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
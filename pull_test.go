@@ -0,0 +1,79 @@
+package git
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestPullHandler(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := &Repo{URL: remote.URL(), Path: dir, Branch: "master", Name: "site", PullToken: "pull-token"}
+	check(t, repo.Pull())
+	other := &Repo{URL: "https://github.com/user/other.git", Branch: "master", PullToken: "other-token"}
+
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+	pull := PullHandler{Path: "/pull", Repos: []*Repo{repo, other}, Next: next}
+
+	hash := remote.commit(t, "index.html", "second")
+
+	for i, test := range []struct {
+		method string
+		url    string
+		token  string
+		code   int
+	}{
+		{"POST", "/other", "pull-token", http.StatusNotFound},
+		{"GET", "/pull?repo=site", "pull-token", http.StatusMethodNotAllowed},
+		{"POST", "/pull?repo=missing", "pull-token", http.StatusNotFound},
+		// the repo is required with several repos
+		{"POST", "/pull", "pull-token", http.StatusNotFound},
+		{"POST", "/pull?repo=site", "", http.StatusUnauthorized},
+		{"POST", "/pull?repo=site", "other-token", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		check(t, err)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if code, _ := pull.ServeHTTP(httptest.NewRecorder(), req); code != test.code {
+			t.Errorf("Test %v: Expected status %v found %v", i, test.code, code)
+		}
+	}
+	if repo.lastCommit == hash {
+		t.Fatal("Expected no pull without authorization")
+	}
+
+	for _, id := range []string{"site", remote.URL().String()} {
+		req, err := http.NewRequest("POST", "/pull?repo="+id, nil)
+		check(t, err)
+		req.Header.Set("Authorization", "Bearer pull-token")
+		rec := httptest.NewRecorder()
+		code, err := pull.ServeHTTP(rec, req)
+		check(t, err)
+		if code != http.StatusOK {
+			t.Fatalf("Expected status %v found %v", http.StatusOK, code)
+		}
+
+		var status RepoStatus
+		check(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		if status.LastCommit != hash || status.Failed {
+			t.Errorf("Expected pull of %v found %+v", hash, status)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const (
+	// DefaultPushMessage is the message of the commits
+	// of the local changes pushed upstream.
+	DefaultPushMessage = "Update from Caddy"
+
+	// pushAuthor is the author of the commits of the local changes.
+	pushAuthor = "caddy-git"
+
+	// pushEmail is the email of pushAuthor.
+	pushEmail = "caddy-git@localhost"
+)
+
+// CommitAndPush commits the local changes of the worktree of r and
+// pushes them to the remote branch. Nothing is done if the worktree
+// is clean or r is not cloned yet.
+func (r *Repo) CommitAndPush() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.pulled {
+		return nil
+	}
+
+	ctx := r.context()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return err
+	}
+	head, err := gr.Head()
+	if err != nil {
+		return err
+	}
+	hash, err := r.commitChanges(gr)
+	if err != nil || hash == "" {
+		return err
+	}
+
+	auth, err := r.auth()
+	if err != nil {
+		r.uncommit(gr, head.Hash())
+		return err
+	}
+	branch := "refs/heads/" + r.Branch
+	err = gr.PushContext(ctx, &git.PushOptions{
+		RemoteName: r.remoteName(),
+		RefSpecs:   []config.RefSpec{config.RefSpec(branch + ":" + branch)},
+		Auth:       auth,
+		Progress:   r.progress(),
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		r.uncommit(gr, head.Hash())
+		return fmt.Errorf("cannot push commit %v of %v: %v", hash, r.label(), err)
+	}
+
+	// the next pull finds the pushed commit up to date
+	r.lastCommit = hash
+	Logger().Printf("%v pushed local changes as commit %v.\n", r.label(), hash)
+	return nil
+}
+
+// commitChanges stages the changes of the tracked files of the worktree
+// of gr and commits them. It returns the hash of the new commit, or an
+// empty string if there is no change. Untracked files e.g. written by
+// the then commands and the deploy marker are not committed.
+func (r *Repo) commitChanges(gr *git.Repository) (string, error) {
+	w, err := gr.Worktree()
+	if err != nil {
+		return "", err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return "", err
+	}
+
+	var staged bool
+	for file, s := range status {
+		if s.Worktree == git.Unmodified && s.Staging == git.Unmodified {
+			continue
+		}
+		if s.Worktree == git.Untracked {
+			continue
+		}
+		if r.DeployMarker != "" && filepath.Clean(file) == filepath.Clean(r.DeployMarker) {
+			continue
+		}
+		if _, err := w.Add(file); err != nil {
+			return "", err
+		}
+		staged = true
+	}
+	if !staged {
+		return "", nil
+	}
+
+	message := r.PushMessage
+	if message == "" {
+		message = DefaultPushMessage
+	}
+	hash, err := w.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: pushAuthor, Email: pushEmail, When: time.Now()},
+	})
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// uncommit moves the branch of gr back to head after a failed push,
+// keeping the changes in the worktree, for the next pulls not to
+// diverge from the remote branch. The changes are committed again
+// by the next push.
+func (r *Repo) uncommit(gr *git.Repository, head plumbing.Hash) {
+	w, err := gr.Worktree()
+	if err == nil {
+		err = w.Reset(&git.ResetOptions{Commit: head, Mode: git.MixedReset})
+	}
+	if err != nil {
+		Logger().Printf("Cannot undo the unpushed commit of %v: %v\n", r.label(), err)
+	}
+}
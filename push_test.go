@@ -0,0 +1,102 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestCommitAndPush(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	first := remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Push = true
+	repo.DeployMarker = ".deployed"
+	check(t, repo.Pull())
+
+	tests := []struct {
+		files   map[string]string // files written before the push
+		changed bool
+	}{
+		{map[string]string{".deployed": first}, false},
+		{map[string]string{"build.html": "built"}, false},
+		{map[string]string{"index.html": "edited"}, true},
+		{nil, false},
+	}
+	for i, test := range tests {
+		for name, content := range test.files {
+			check(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), os.FileMode(0644)))
+		}
+
+		before, err := remote.repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+		check(t, err)
+		check(t, repo.CommitAndPush())
+		after, err := remote.repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+		check(t, err)
+
+		if changed := before.Hash() != after.Hash(); changed != test.changed {
+			t.Fatalf("Test %v: expected pushed %v, found %v", i, test.changed, changed)
+		}
+		if !test.changed {
+			continue
+		}
+		if repo.lastCommit != after.Hash().String() {
+			t.Errorf("Test %v: expected last commit %v found %v", i, after.Hash(), repo.lastCommit)
+		}
+
+		commit, err := remote.repo.CommitObject(after.Hash())
+		check(t, err)
+		if commit.Message != DefaultPushMessage {
+			t.Errorf("Test %v: expected message %q found %q", i, DefaultPushMessage, commit.Message)
+		}
+		for name, content := range test.files {
+			file, err := commit.File(name)
+			check(t, err)
+			if data, err := file.Contents(); err != nil || data != content {
+				t.Errorf("Test %v: expected %v pushed with %q found %q", i, name, content, data)
+			}
+		}
+		for _, name := range []string{".deployed", "build.html"} {
+			if _, err := commit.File(name); err == nil {
+				t.Errorf("Test %v: expected untracked %v not pushed", i, name)
+			}
+		}
+	}
+
+	// the pushed commit is up to date
+	pushed := repo.lastCommit
+	check(t, repo.Pull())
+	if repo.lastCommit != pushed {
+		t.Errorf("Expected commit %v after the pull found %v", pushed, repo.lastCommit)
+	}
+
+	// a failed push leaves the branch at the pulled commit
+	remote.commit(t, "index.html", "upstream")
+	check(t, ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("diverged"), os.FileMode(0644)))
+	if err := repo.CommitAndPush(); err == nil {
+		t.Fatal("Expected push of a diverged commit to fail")
+	}
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	head, err := gr.Head()
+	check(t, err)
+	if head.Hash().String() != pushed {
+		t.Errorf("Expected branch at %v after the failed push found %v", pushed, head.Hash())
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "index.html")); err != nil || string(data) != "diverged" {
+		t.Errorf("Expected local changes kept found %q %v", data, err)
+	}
+}
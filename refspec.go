@@ -0,0 +1,57 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// isRefSpec checks if spec is a valid fetch refspec naming a single
+// ref e.g. refs/pull/123/head or +refs/pull/123/head:refs/pr/123.
+func isRefSpec(spec string) bool {
+	rs := config.RefSpec(strings.TrimPrefix(spec, "+"))
+	if !strings.Contains(string(rs), ":") {
+		rs += ":" + rs
+	}
+	return strings.HasPrefix(rs.Src(), "refs/") && rs.Validate() == nil && !rs.IsWildcard()
+}
+
+// refSpec returns the forced fetch refspec of r.RefSpec. A ref without
+// destination is fetched under the remote refs of r e.g. refs/pull/123/head
+// into refs/remotes/origin/pull/123/head.
+func (r *Repo) refSpec() config.RefSpec {
+	spec := strings.TrimPrefix(r.RefSpec, "+")
+	if !strings.Contains(spec, ":") {
+		spec += ":refs/remotes/" + r.remoteName() + "/" + strings.TrimPrefix(spec, "refs/")
+	}
+	// the ref may be rewritten e.g. by a force push to a pull request
+	return config.RefSpec("+" + spec)
+}
+
+// refSpecNotFound returns the error of r.RefSpec missing from the remote.
+func (r *Repo) refSpecNotFound() error {
+	return fmt.Errorf("ref %q not found on remote %v", r.refSpec().Src(), r.URL)
+}
+
+// checkoutRefSpec checks out the commit fetched by r.RefSpec,
+// leaving the worktree detached at it.
+func (r *Repo) checkoutRefSpec(gr *git.Repository) error {
+	spec := r.refSpec()
+	name := spec.Dst(plumbing.ReferenceName(spec.Src()))
+	ref, err := gr.Reference(name, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return r.refSpecNotFound()
+	}
+	if err != nil {
+		return err
+	}
+	// the ref may name an annotated tag
+	hash, err := tagCommit(gr, ref)
+	if err != nil {
+		return err
+	}
+	return r.checkoutCommit(gr, hash.String())
+}
@@ -0,0 +1,61 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestRefSpec(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	master := remote.commit(t, "index.html", "master")
+	head, err := remote.repo.Head()
+	check(t, err)
+
+	// a pull request ref, not reachable from any branch
+	pr := remote.commit(t, "index.html", "pull request")
+	check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference("refs/pull/1/head", plumbing.NewHash(pr))))
+	check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), plumbing.NewHash(master))))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.RefSpec = "refs/pull/1/head"
+
+	// contents returns the content of index.html in the worktree
+	contents := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		return string(data)
+	}
+
+	check(t, repo.Pull())
+	if repo.lastCommit != pr || contents() != "pull request" {
+		t.Errorf("Expected ref checked out at %v found %v with %q", pr, repo.lastCommit, contents())
+	}
+
+	// the pull request gets a new commit
+	check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), plumbing.NewHash(pr))))
+	updated := remote.commit(t, "index.html", "updated")
+	check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference("refs/pull/1/head", plumbing.NewHash(updated))))
+	check(t, repo.Pull())
+	if repo.lastCommit != updated || contents() != "updated" {
+		t.Errorf("Expected ref checked out at %v found %v with %q", updated, repo.lastCommit, contents())
+	}
+
+	repo.RefSpec = "refs/pull/2/head"
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected missing ref error found %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package git
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry holds the repos managed by each server, keyed by the
+// addresses of the server blocks of the Caddyfile e.g. example.com.
+var registry = struct {
+	servers map[string]Git
+	sync.RWMutex
+}{servers: make(map[string]Git)}
+
+// register records git as the repos managed by the servers.
+func register(servers []string, git Git) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, server := range servers {
+		registry.servers[server] = git
+	}
+}
+
+// unregister removes git from the repos managed by the servers, unless
+// the servers were registered again since e.g. by a restart.
+func unregister(servers []string, git Git) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, server := range servers {
+		if registered, ok := registry.servers[server]; ok && sameRepos(registered, git) {
+			delete(registry.servers, server)
+		}
+	}
+}
+
+// sameRepos checks if a and b hold the same repos.
+func sameRepos(a, b Git) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Repos returns the repos managed by the server, as addressed in the
+// Caddyfile, nil if there is none.
+func Repos(server string) Git {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append(Git(nil), registry.servers[server]...)
+}
+
+// Servers returns the sorted addresses of the servers managing repos.
+func Servers() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	servers := make([]string, 0, len(registry.servers))
+	for server := range registry.servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
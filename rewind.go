@@ -0,0 +1,122 @@
+package git
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// rewindError is the error of a pull refused as it would move the
+// worktree to a commit not descending from the deployed one.
+type rewindError struct {
+	repo, from, to string
+}
+
+func (e rewindError) Error() string {
+	return fmt.Sprintf("refused to rewind %v from %v to %v, allow_rewind is off", e.repo, e.from, e.to)
+}
+
+// isRewindError checks if err is the error of a refused rewind.
+func isRewindError(err error) bool {
+	_, ok := err.(rewindError)
+	return ok
+}
+
+// checkHead checks if the worktree may move to the commit hash: it
+// descends from the deployed commit, or r.AllowRewind is set. The
+// rewinds of the branch e.g. by a force push, of a moved tag or of
+// a mirror are refused otherwise. pulledHead checks the commit of
+// every pull, the pull paths check it first when they can to leave
+// the worktree untouched.
+func (r *Repo) checkHead(gr *git.Repository, hash plumbing.Hash) error {
+	if r.AllowRewind || !r.pulled || r.lastCommit == "" || hash.String() == r.lastCommit {
+		return nil
+	}
+	ok, err := isAncestor(gr, plumbing.NewHash(r.lastCommit), hash)
+	if err == plumbing.ErrObjectNotFound {
+		// the history of shallow clones is partial, the ancestry
+		// of their commits cannot always be told
+		r.logf(LogVerbose, "Cannot tell if %v descends from %v in %v.\n", hash, r.lastCommit, r.label())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return r.rewindError(hash)
+	}
+	return nil
+}
+
+// checkClonedHead checks if HEAD of a new clone may replace the
+// deployed commit, see checkHead.
+func (r *Repo) checkClonedHead(gr *git.Repository) error {
+	head, err := gr.Head()
+	if err != nil {
+		return err
+	}
+	return r.checkHead(gr, head.Hash())
+}
+
+// restoreHead moves the worktree of gr from the commit current
+// back to the deployed commit after a refused rewind.
+func (r *Repo) restoreHead(gr *git.Repository, current *object.Commit) error {
+	deployed := plumbing.NewHash(r.lastCommit)
+	if len(r.Sparse) > 0 {
+		commit, err := gr.CommitObject(deployed)
+		if err != nil {
+			return err
+		}
+		if err := exportFiles(commit, current, r.Path, r.inSparse); err != nil {
+			return err
+		}
+		return checkoutSparseHead(gr, r.Branch, deployed)
+	}
+	w, err := gr.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Reset(&git.ResetOptions{Commit: deployed, Mode: git.HardReset})
+}
+
+// pullRewind handles a pull refused by go-git as the remote branch is
+// not a fast-forward of the worktree: the worktree is reset to the remote
+// branch if r.AllowRewind is set, else it is left at the deployed commit.
+func (r *Repo) pullRewind(ctx context.Context, gr *git.Repository, w *git.Worktree) error {
+	if r.AllowRewind {
+		return r.resetHard(ctx, gr, w)
+	}
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err != nil {
+		return err
+	}
+	return r.rewindError(ref.Hash())
+}
+
+// rewindError returns the error of the refused move of the
+// worktree to the commit hash.
+func (r *Repo) rewindError(hash plumbing.Hash) error {
+	return rewindError{repo: r.label(), from: r.lastCommit, to: hash.String()}
+}
+
+// isAncestor checks if the commit ancestor is reachable
+// from the commit hash in gr.
+func isAncestor(gr *git.Repository, ancestor, hash plumbing.Hash) (bool, error) {
+	commit, err := gr.CommitObject(hash)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	err = object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == ancestor {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return found, err
+}
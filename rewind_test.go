@@ -0,0 +1,149 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestAllowRewind(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	tests := []struct {
+		clean       bool
+		allowRewind bool
+		content     string
+	}{
+		{false, false, "second"},
+		{true, false, "second"},
+		{false, true, "rewritten"},
+		{true, true, "rewritten"},
+	}
+	for i, test := range tests {
+		remote := newRemote(t)
+		first := remote.commit(t, "index.html", "first")
+		head, err := remote.repo.Head()
+		check(t, err)
+
+		dir := tempDir(t)
+		repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Clean: test.clean})
+		repo.MinInterval = 0
+		repo.AllowRewind = test.allowRewind
+		check(t, repo.Pull())
+
+		// a fast-forward is accepted
+		second := remote.commit(t, "index.html", "second")
+		check(t, repo.Pull())
+		if repo.lastCommit != second {
+			t.Errorf("Test %v: Expected fast-forward to %v found %v", i, second, repo.lastCommit)
+		}
+
+		// force push of a rewritten history
+		check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), plumbing.NewHash(first))))
+		rewritten := remote.commit(t, "index.html", "rewritten")
+		err = repo.Pull()
+
+		// refused rewinds are reported as failed pulls
+		expected := second
+		if test.allowRewind {
+			expected = rewritten
+			check(t, err)
+		} else if !isRewindError(err) || !repo.Status().Failed {
+			t.Errorf("Test %v: Expected refused rewind reported found %v", i, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		if repo.lastCommit != expected || string(data) != test.content {
+			t.Errorf("Test %v: Expected commit %v with %q found %v with %q", i, expected, test.content, repo.lastCommit, data)
+		}
+
+		os.RemoveAll(remote.dir)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRewindModes(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	tests := []struct {
+		setup func(*Repo)
+		tag   bool // the pulled tag is moved
+	}{
+		{func(r *Repo) { r.Sparse = []string{""} }, false},
+		{func(r *Repo) { r.Tag = "v1" }, true},
+	}
+	for i, test := range tests {
+		remote := newRemote(t)
+		first := remote.commit(t, "index.html", "first")
+		second := remote.commit(t, "index.html", "second")
+		head, err := remote.repo.Head()
+		check(t, err)
+		if test.tag {
+			remote.tag(t, "v1", second)
+		}
+
+		dir := tempDir(t)
+		repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+		repo.MinInterval = 0
+		test.setup(repo)
+		check(t, repo.Pull())
+
+		// force push of a rewritten history
+		check(t, remote.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), plumbing.NewHash(first))))
+		rewritten := remote.commit(t, "index.html", "rewritten")
+		if test.tag {
+			check(t, remote.repo.DeleteTag("v1"))
+			remote.tag(t, "v1", rewritten)
+		}
+
+		if err := repo.Pull(); !isRewindError(err) {
+			t.Errorf("Test %v: Expected refused rewind found %v", i, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		if repo.lastCommit != second || string(data) != "second" {
+			t.Errorf("Test %v: Expected commit %v kept found %v with %q", i, second, repo.lastCommit, data)
+		}
+
+		os.RemoveAll(remote.dir)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRewindRestored(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	first := remote.commit(t, "index.html", "first")
+	second := remote.commit(t, "index.html", "second")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	// a pull moved the worktree back without checking it
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	w, err := gr.Worktree()
+	check(t, err)
+	check(t, w.Reset(&gogit.ResetOptions{Commit: plumbing.NewHash(first), Mode: gogit.HardReset}))
+
+	if err := repo.pulledHead(context.Background(), gr); !isRewindError(err) {
+		t.Errorf("Expected refused rewind found %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	check(t, err)
+	if repo.lastCommit != second || string(data) != "second" {
+		t.Errorf("Expected commit %v restored found %v with %q", second, repo.lastCommit, data)
+	}
+}
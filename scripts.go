@@ -1,6 +1,122 @@
 package git
 
-var (
-	// gitBinary holds the absolute path to git executable
-	gitBinary string
+import (
+	"context"
+	"runtime"
+	"strings"
+
+	"github.com/akhenakh/caddy-puregit/gitos"
 )
+
+// goos is the operating system executing the scripts.
+var goos = runtime.GOOS
+
+// NewScriptThen creates a new Then command executing script with sh,
+// or cmd on Windows. A script spanning multiple lines is the body of
+// the script, otherwise it is the path to the script file.
+func NewScriptThen(script string) Then {
+	return &scriptCmd{script: script}
+}
+
+// NewShellScriptThen creates a new Then command executing
+// script like NewScriptThen, with shell instead of sh.
+func NewShellScriptThen(shell, script string) Then {
+	return &scriptCmd{script: script, shell: shell}
+}
+
+type scriptCmd struct {
+	script string
+	shell  string // shell executing the script, sh if empty
+}
+
+// batch reports whether the script is a batch file executed
+// by cmd, the default on Windows.
+func (s *scriptCmd) batch() bool {
+	return s.shell == "" && goos == "windows"
+}
+
+// shellCommand returns the command executing the script file.
+func (s *scriptCmd) shellCommand(file string) (string, []string) {
+	switch {
+	case s.batch():
+		return "cmd", []string{"/C", file}
+	case s.shell == "":
+		return "sh", []string{file}
+	}
+	return s.shell, []string{file}
+}
+
+// isBody reports whether the script is a script body
+// rather than the path to a script file.
+func (s *scriptCmd) isBody() bool {
+	return strings.Contains(s.script, "\n")
+}
+
+// Command returns the script path, or the first line of the script body.
+func (s *scriptCmd) Command() string {
+	if !s.isBody() {
+		name, args := s.shellCommand(s.script)
+		return name + " " + strings.Join(args, " ")
+	}
+	lines := strings.Split(strings.TrimSpace(s.script), "\n")
+	if len(lines) > 1 {
+		return "script " + strings.TrimSpace(lines[0]) + " ..."
+	}
+	return "script " + strings.TrimSpace(lines[0])
+}
+
+// Exec executes the script like ExecContext.
+func (s *scriptCmd) Exec(dir string) error {
+	return s.ExecContext(context.Background(), dir, nil)
+}
+
+// ExecContext executes the script in a single invocation of the shell. A
+// script body is written to a temporary file removed once the script
+// exits, whether it succeeded, failed or was killed.
+func (s *scriptCmd) ExecContext(ctx context.Context, dir string, env []string) error {
+	if !s.isBody() {
+		name, args := s.shellCommand(s.script)
+		return execCmd(ctx, s.Command(), name, args, dir, env)
+	}
+
+	// cmd only executes the files with a batch extension
+	pattern := "caddy"
+	if s.batch() {
+		pattern = "caddy*.bat"
+	}
+	file, err := writeScriptFile([]byte(s.script), pattern)
+	if err != nil {
+		return err
+	}
+	defer gos.Remove(file.Name())
+
+	name, args := s.shellCommand(file.Name())
+	return execCmd(ctx, s.Command(), name, args, dir, env)
+}
+
+// writeScriptFile writes content to a temporary file named after
+// pattern, as with TempFile. It changes the temporary file mode to
+// executable, except on Windows where the mode is not used, and
+// closes it to prepare it for execution. The file is removed if it
+// cannot be prepared.
+func writeScriptFile(content []byte, pattern string) (file gitos.File, err error) {
+	if file, err = gos.TempFile("", pattern); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			gos.Remove(file.Name())
+		}
+	}()
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if goos != "windows" {
+		if err = file.Chmod(0700); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, file.Close()
+}
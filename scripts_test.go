@@ -0,0 +1,139 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gitos"
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestScriptThen(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the scripts are executed by the operating system
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	script := NewScriptThen("echo first > out\necho second >> out\n")
+	if err := execCommand(context.Background(), script, dir, nil); err != nil {
+		t.Fatalf("Error not expected but found %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "first\nsecond\n" {
+		t.Errorf("Expected both lines executed in order found %q", out)
+	}
+
+	path := filepath.Join(dir, "deploy.sh")
+	if err := ioutil.WriteFile(path, []byte("echo deployed > out\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand(context.Background(), NewScriptThen(path), dir, nil); err != nil {
+		t.Fatalf("Error not expected but found %v", err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(dir, "out")); string(out) != "deployed\n" {
+		t.Errorf("Expected script file executed found %q", out)
+	}
+
+	script = NewScriptThen("echo building\nexit 3\n")
+	err = execCommand(context.Background(), script, dir, nil)
+	if err == nil || !strings.Contains(err.Error(), "script echo building ...") || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected error of failing script found %v", err)
+	}
+}
+
+func TestShellScriptThen(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	if got := NewShellScriptThen("/bin/bash", "deploy.sh").Command(); got != "/bin/bash deploy.sh" {
+		t.Errorf("Expected script executed with bash found %v", got)
+	}
+
+	// the scripts are executed by the operating system
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	bash, err := gos.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// [[ is not supported by sh on all systems
+	script := NewShellScriptThen(bash, "if [[ -d . ]]; then echo bash > out; fi\necho done\n")
+	if err := execCommand(context.Background(), script, dir, nil); err != nil {
+		t.Fatalf("Error not expected but found %v", err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(dir, "out")); string(out) != "bash\n" {
+		t.Errorf("Expected script executed with bash found %q", out)
+	}
+}
+
+func TestScriptThenWindows(t *testing.T) {
+	defer func(g string) { goos = g }(goos)
+
+	tests := []struct {
+		goos     string
+		script   Then
+		expected string
+		mode     os.FileMode
+	}{
+		{"linux", NewScriptThen("deploy.sh"), "sh deploy.sh", 0700},
+		{"windows", NewScriptThen("deploy.bat"), "cmd /C deploy.bat", 0},
+		{"windows", NewShellScriptThen("bash", "deploy.sh"), "bash deploy.sh", 0},
+	}
+	for i, test := range tests {
+		goos = test.goos
+		if command := test.script.Command(); command != test.expected {
+			t.Errorf("Test %v: expected %v found %v", i, test.expected, command)
+		}
+
+		// the mode of the script files is not used on Windows
+		file, err := writeScriptFile([]byte("echo deployed\n"), "caddy")
+		check(t, err)
+		info, err := file.Stat()
+		check(t, err)
+		if info.Mode() != test.mode {
+			t.Errorf("Test %v: expected mode %v found %v", i, test.mode, info.Mode())
+		}
+	}
+}
+
+func TestScriptThenRemovesFile(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	// the scripts are executed by the operating system
+	SetOS(gitos.GitOS{})
+	defer SetOS(gittest.FakeOS)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// temporary files are created in dir
+	tmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmp)
+
+	for _, script := range []string{"echo built\n", "echo failed\nexit 1\n"} {
+		execCommand(context.Background(), NewScriptThen(script), dir, nil)
+
+		files, err := filepath.Glob(filepath.Join(dir, "caddy*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) > 0 {
+			t.Errorf("Expected script file removed found %v", files)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package git
 
 import (
 	"sync"
+	"time"
 
 	"github.com/akhenakh/caddy-puregit/gitos"
 )
@@ -18,6 +19,8 @@ type repoService struct {
 	repo   *Repo
 	ticker gitos.Ticker  // ticker to tick at intervals
 	halt   chan struct{} // channel to notify service to halt and stop pulling.
+	done   chan struct{} // closed when the service has stopped.
+	offset time.Duration // delay before the ticker starts
 }
 
 // Start starts a new background service to pull periodically.
@@ -28,15 +31,42 @@ func Start(repo *Repo) {
 		return
 	}
 	service := &repoService{
-		repo,
-		gos.NewTicker(repo.Interval),
-		make(chan struct{}),
+		repo:   repo,
+		halt:   make(chan struct{}),
+		done:   make(chan struct{}),
+		offset: jitter(repo),
 	}
 	go func(s *repoService) {
+		defer close(s.done)
+
+		// delay the ticker to spread the pulls of the repos
+		if s.offset > 0 {
+			delay := gos.NewTicker(s.offset)
+			select {
+			case <-delay.C():
+				delay.Stop()
+			case <-s.halt:
+				delay.Stop()
+				return
+			}
+		}
+
+		s.ticker = gos.NewTicker(repo.Interval)
 		for {
 			select {
 			case <-s.ticker.C():
-				err := repo.Pull()
+				// the local changes are pushed before pulling
+				if repo.Push {
+					if err := repo.CommitAndPush(); err != nil {
+						Logger().Println(err)
+					}
+				}
+				// skip the tick if a pull is still running
+				// instead of piling up pulls
+				pulled, err := repo.TryPull()
+				if !pulled {
+					Logger().Printf("Pull of %v still running, skipping.\n", repo.label())
+				}
 				if err != nil {
 					Logger().Println(err)
 				}
@@ -51,6 +81,23 @@ func Start(repo *Repo) {
 	Services.add(service)
 }
 
+// jitter returns a random delay shorter than the interval of repo
+// if jitter is enabled, 0 otherwise.
+func jitter(repo *Repo) time.Duration {
+	if !repo.Jitter {
+		return 0
+	}
+	return time.Duration(gos.Int63n(int64(repo.Interval)))
+}
+
+// Stop stops the background services pulling repo, aborting the running
+// pull if any. It waits until the services are terminated before returning.
+func Stop(repo *Repo) {
+	Services.stop(func(r *Repo) bool {
+		return r == repo
+	}, -1)
+}
+
 // services stores all repoServices
 type services struct {
 	services []*repoService
@@ -70,26 +117,37 @@ func (s *services) add(r *repoService) {
 // If limit is less than zero, it is ignored.
 // TODO find better ways to identify repos
 func (s *services) Stop(repoURL string, limit int) {
-	s.Lock()
-	defer s.Unlock()
+	s.stop(func(repo *Repo) bool {
+		return string(repo.URL) == repoURL
+	}, limit)
+}
 
-	// locate repos
-	for i, j := 0, 0; i < len(s.services) && ((limit >= 0 && j < limit) || limit < 0); i++ {
-		service := s.services[i]
-		if string(service.repo.URL) == repoURL {
-			// send halt signal
-			service.halt <- struct{}{}
-			s.services[i] = nil
-			j++
-		}
+// stop stops at most `limit` running services of the repos matched by match.
+func (s *services) stop(match func(*Repo) bool, limit int) {
+	// the services are halted unlocked, as their
+	// running pulls may take a while to abort
+	for _, service := range s.remove(match, limit) {
+		close(service.halt)
+		service.repo.Cancel()
+		<-service.done
 	}
+}
+
+// remove removes at most `limit` services of the repos matched
+// by match from s, and returns them.
+func (s *services) remove(match func(*Repo) bool, limit int) []*repoService {
+	s.Lock()
+	defer s.Unlock()
 
-	// remove them from repos list
+	var removed []*repoService
 	services := s.services[:0]
-	for _, s := range s.services {
-		if s != nil {
-			services = append(services, s)
+	for _, service := range s.services {
+		if match(service.repo) && (limit < 0 || len(removed) < limit) {
+			removed = append(removed, service)
+			continue
 		}
+		services = append(services, service)
 	}
 	s.services = services
+	return removed
 }
@@ -2,6 +2,8 @@ package git
 
 import (
 	"fmt"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -71,3 +73,122 @@ func TestServices(t *testing.T) {
 		t.Errorf("Expected %v service(s), found %v", 0, len(Services.services))
 	}
 }
+
+func TestStop(t *testing.T) {
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := &Repo{URL: remote.URL(), Path: dir, Branch: "master", Interval: time.Second}
+	check(t, repo.Pull())
+
+	Start(repo)
+	service := Services.services[len(Services.services)-1]
+
+	// wait for a pull by the service
+	lastPull := repo.Status().LastPull
+	for i := 0; i < 50 && repo.Status().LastPull == lastPull; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if repo.Status().LastPull == lastPull {
+		t.Fatalf("Expected the service to pull")
+	}
+
+	Stop(repo)
+	select {
+	case <-service.done:
+	default:
+		t.Fatalf("Expected the service to be terminated")
+	}
+	for _, s := range Services.services {
+		if s.repo == repo {
+			t.Errorf("Expected the service to be removed")
+		}
+	}
+
+	// no pull happens once stopped
+	lastPull = repo.Status().LastPull
+	time.Sleep(time.Second / time.Duration(gittest.TimeSpeed) * 3)
+	if repo.Status().LastPull != lastPull {
+		t.Errorf("Expected no pull after stop")
+	}
+
+	// stopping the service doesn't cancel the next pulls e.g. by webhooks
+	remote.commit(t, "index.html", "second")
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+}
+
+func TestOverlappingPulls(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// pulls block until cancelled, longer than the interval
+	repo := &Repo{URL: "blocking://example.com/user/repo.git", Path: dir, Branch: "master", Interval: time.Second / 10}
+	atomic.StoreInt32(&blockingUploads, 0)
+
+	// a pull e.g. triggered by a webhook
+	done := make(chan struct{})
+	go func() {
+		repo.Pull()
+		close(done)
+	}()
+	time.Sleep(time.Second / 10)
+
+	Start(repo)
+	time.Sleep(time.Second / 2)
+
+	if pulled, _ := repo.TryPull(); pulled {
+		t.Errorf("Expected pull to be skipped while another one is running")
+	}
+
+	Stop(repo)
+	<-done
+	if n := atomic.LoadInt32(&blockingUploads); n != 1 {
+		t.Errorf("Expected a single pull found %v", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	start := func() []time.Duration {
+		var offsets []time.Duration
+		for i := 0; i < 3; i++ {
+			repo := &Repo{URL: RepoURL(fmt.Sprintf("jitter%v", i)), Interval: time.Hour, Jitter: true}
+			Start(repo)
+			offsets = append(offsets, Services.services[len(Services.services)-1].offset)
+			Stop(repo)
+		}
+		return offsets
+	}
+
+	gittest.Seed(42)
+	offsets := start()
+	for i, offset := range offsets {
+		if offset < 0 || offset >= time.Hour {
+			t.Errorf("Expected offset %v within the interval, found %v", i, offset)
+		}
+		for _, other := range offsets[:i] {
+			if offset == other {
+				t.Errorf("Expected distinct offsets, found %v", offsets)
+			}
+		}
+	}
+
+	gittest.Seed(42)
+	if again := start(); fmt.Sprint(again) != fmt.Sprint(offsets) {
+		t.Errorf("Expected offsets %v with the same seed, found %v", offsets, again)
+	}
+
+	// without jitter the ticker starts right away
+	repo := &Repo{URL: "nojitter", Interval: time.Hour}
+	Start(repo)
+	if offset := Services.services[len(Services.services)-1].offset; offset != 0 {
+		t.Errorf("Expected no offset found %v", offset)
+	}
+	Stop(repo)
+}
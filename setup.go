@@ -1,21 +1,35 @@
 package git
 
 import (
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	gogit "gopkg.in/src-d/go-git.v4"
 )
 
 const (
 	// DefaultInterval is the minimum interval to delay before
 	// requesting another git pull
 	DefaultInterval time.Duration = time.Hour * 1
+
+	// DefaultMinInterval is the minimum time between two pulls,
+	// pulls requested sooner are ignored
+	DefaultMinInterval time.Duration = time.Second * 5
+
+	// DefaultRetryBackoff is the delay before retrying a failed
+	// pull, doubled after each retry
+	DefaultRetryBackoff time.Duration = time.Second * 1
 )
 
 func init() {
@@ -39,35 +53,211 @@ func setup(c *caddy.Controller) error {
 	// functions to execute at startup
 	var startupFuncs []func() error
 
+	// limit of concurrent clones, shared by all repos
+	var maxClones int
+
+	// log file and format, shared by all repos
+	var logPath, logFormat string
+
+	// the http requests are sent with the plugin user agent,
+	// and through the configured proxies of this instance
+	installHTTPClientOnce.Do(installHTTPClient)
+	instance := c.Context()
+	proxies.use(instance)
+	userAgents.use(instance)
+	useInstanceMaxClones(instance)
+
 	// loop through all repos and and start monitoring
 	for i := range git {
 		repo := git.Repo(i)
 
+		if repo.ProxyURL != "" {
+			proxy, err := parseProxy(repo.ProxyURL)
+			if err != nil {
+				return err
+			}
+			if err := setProxy(instance, repo.Host, proxy); err != nil {
+				return err
+			}
+		}
+
+		if repo.UserAgent != "" {
+			if err := setUserAgent(instance, repo.Host, repo.UserAgent); err != nil {
+				return err
+			}
+		}
+
+		if repo.MaxConcurrentClones > 0 {
+			if maxClones > 0 && maxClones != repo.MaxConcurrentClones {
+				return c.Errf("conflicting max_concurrent_clones %v and %v", maxClones, repo.MaxConcurrentClones)
+			}
+			maxClones = repo.MaxConcurrentClones
+		}
+
+		if repo.LogPath != "" {
+			if logPath != "" && logPath != repo.LogPath {
+				return c.Errf("conflicting log %v and %v", logPath, repo.LogPath)
+			}
+			logPath = repo.LogPath
+		}
+		if repo.LogFormat != "" {
+			if logFormat != "" && logFormat != repo.LogFormat {
+				return c.Errf("conflicting log_format %v and %v", logFormat, repo.LogFormat)
+			}
+			logFormat = repo.LogFormat
+		}
+
 		// If a HookUrl is set, we switch to event based pulling.
 		// Install the url handler
 		if repo.Hook.URL != "" {
 			hookRepos = append(hookRepos, repo)
-			startupFuncs = append(startupFuncs, repo.Pull)
-		} else {
-			startupFuncs = append(startupFuncs, func() error {
-				// Start service routine in background
-				Start(repo)
+		}
+		startupFuncs = append(startupFuncs, startup(repo))
+	}
 
-				// Do a pull right away to return error
-				return repo.Pull()
-			})
+	if maxClones > 0 {
+		if err := setInstanceMaxClones(instance, maxClones); err != nil {
+			return c.Err(err.Error())
 		}
 	}
 
 	// ensure the functions are executed once per server block
 	// for cases like server1.com, server2.com { ... }
 	c.OncePerServerBlock(func() error {
+		// the log file is opened again by the setup of the new
+		// instance, then closed by the shutdown of the old one
+		closeLog := func() error { return nil }
+		if logPath != "" || logFormat == "json" {
+			var err error
+			if closeLog, err = openLog(logPath, logFormat == "json"); err != nil {
+				return c.Errf("cannot open log %v: %v", logPath, err)
+			}
+		}
+
 		for i := range startupFuncs {
 			c.OnStartup(startupFuncs[i])
 		}
+		// stop pulling and abort running pulls before a restart, so the
+		// new instance doesn't race with the old one, and pull again if
+		// the new configuration fails
+		manager := NewManager(git...)
+		c.OnRestart(func() error {
+			manager.Pause()
+			return nil
+		})
+		c.OnRestartFailed(func() error {
+			proxies.use(instance)
+			userAgents.use(instance)
+			useInstanceMaxClones(instance)
+			manager.Resume()
+			return nil
+		})
+
+		// the repos are listed by Repos until stopped
+		servers := c.ServerBlockKeys
+		if len(servers) == 0 {
+			servers = []string{c.Key}
+		}
+		register(servers, git)
+
+		// the old instance is torn down once the new one started,
+		// killing its then_long commands, and on shutdown
+		c.OnShutdown(func() error {
+			manager.Stop()
+			unregister(servers, git)
+			proxies.remove(instance)
+			userAgents.remove(instance)
+			removeInstanceMaxClones(instance)
+			return closeLog()
+		})
 		return nil
 	})
 
+	// serve the status of all repos on each status path
+	statusPaths := make(map[string]bool)
+	for _, repo := range git {
+		if repo.StatusPath == "" || statusPaths[repo.StatusPath] {
+			continue
+		}
+		statusPaths[repo.StatusPath] = true
+
+		status := &StatusHandler{Path: repo.StatusPath, Repos: git}
+		httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			status.Next = next
+			return status
+		})
+	}
+
+	// serve the health of all repos on each health path
+	healthPaths := make(map[string]bool)
+	for _, repo := range git {
+		if repo.HealthPath == "" || healthPaths[repo.HealthPath] {
+			continue
+		}
+		healthPaths[repo.HealthPath] = true
+
+		health := &HealthHandler{Path: repo.HealthPath, Repos: git}
+		httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			health.Next = next
+			return health
+		})
+	}
+
+	// pull the repos on demand on each pull path
+	pullPaths := make(map[string]bool)
+	for _, repo := range git {
+		if repo.PullPath == "" || pullPaths[repo.PullPath] {
+			continue
+		}
+		pullPaths[repo.PullPath] = true
+
+		var repos []*Repo
+		for _, r := range git {
+			if r.PullPath == repo.PullPath {
+				repos = append(repos, r)
+			}
+		}
+		pull := &PullHandler{Path: repo.PullPath, Repos: repos}
+		httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			pull.Next = next
+			return pull
+		})
+	}
+
+	// register metrics if enabled and serve them on each metrics path
+	metricsPaths := make(map[string]bool)
+	for _, repo := range git {
+		if !repo.Metrics {
+			continue
+		}
+		registerMetrics()
+		if repo.MetricsPath == "" || metricsPaths[repo.MetricsPath] {
+			continue
+		}
+		metricsPaths[repo.MetricsPath] = true
+
+		metrics := &MetricsHandler{Path: repo.MetricsPath}
+		httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			metrics.Next = next
+			return metrics
+		})
+	}
+
+	// set the commit header of the files served from the repos
+	var commitRepos []*Repo
+	for _, repo := range git {
+		if repo.SetCommitHeader {
+			commitRepos = append(commitRepos, repo)
+		}
+	}
+	if len(commitRepos) > 0 {
+		commit := &CommitHandler{Root: httpserver.GetConfig(c).Root, Repos: commitRepos}
+		httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			commit.Next = next
+			return commit
+		})
+	}
+
 	// if there are repo(s) with webhook
 	// return handler
 	if len(hookRepos) > 0 {
@@ -81,25 +271,74 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// ipArgs returns the remaining arguments of c, which must be
+// IPs or CIDR blocks.
+func ipArgs(c *caddy.Controller) ([]string, error) {
+	ips := c.RemainingArgs()
+	if len(ips) == 0 {
+		return nil, c.ArgErr()
+	}
+	for _, ip := range ips {
+		if strings.Contains(ip, "/") {
+			if _, _, err := net.ParseCIDR(ip); err == nil {
+				continue
+			}
+		} else if net.ParseIP(ip) != nil {
+			continue
+		}
+		return nil, c.Errf("invalid ip or cidr %v", ip)
+	}
+	return ips, nil
+}
+
+// startup returns the function starting repo: the periodic pulls are
+// started, unless repo is pulled by webhooks, and repo is pulled right
+// away unless the startup pull is skipped. The error of a best effort
+// repo is logged instead of returned, caddy then starts anyway and the
+// repo is pulled again at the next interval or webhook.
+func startup(repo *Repo) func() error {
+	return func() error {
+		if repo.Hook.URL == "" {
+			// Start service routine in background
+			Start(repo)
+		}
+		if repo.SkipStartupPull {
+			return nil
+		}
+
+		// Do a pull right away to return error
+		err := repo.Pull()
+		if err != nil && repo.BestEffort {
+			Logger().Printf("Initial pull of %v failed, starting anyway: %v\n", repo.label(), err)
+			return nil
+		}
+		return err
+	}
+}
+
 func parse(c *caddy.Controller) (Git, error) {
 	var git Git
 
 	config := httpserver.GetConfig(c)
 	for c.Next() {
-		repo := &Repo{Branch: "master", Interval: DefaultInterval, Path: config.Root}
+		repo := &Repo{
+			Branch:         "master",
+			Remote:         "origin",
+			Interval:       DefaultInterval,
+			MinInterval:    DefaultMinInterval,
+			SubmoduleDepth: defaultSubmoduleDepth,
+			Retries:        numRetries,
+			RetryBackoff:   DefaultRetryBackoff,
+		}
 
 		args := c.RemainingArgs()
 
-		clonePath := func(s string) string {
-			if filepath.IsAbs(s) {
-				return filepath.Clean(s)
-			}
-			return filepath.Join(config.Root, s)
-		}
+		// the clone path is resolved once base_dir is known
+		var clonePath string
 
 		switch len(args) {
 		case 2:
-			repo.Path = clonePath(args[1])
+			clonePath = args[1]
 			fallthrough
 		case 1:
 			repo.URL = RepoURL(args[0])
@@ -116,25 +355,332 @@ func parse(c *caddy.Controller) (Git, error) {
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				repo.Path = clonePath(c.Val())
+				clonePath = c.Val()
+			case "base_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.BaseDir = resolvePath(config.Root, c.Val())
 			case "branch":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				repo.Branch = c.Val()
+				branch, err := expandEnv(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+
+				// optional path of an additional branch
+				if c.NextArg() {
+					repo.Branches = append(repo.Branches, &BranchSpec{Branch: branch, Path: c.Val()})
+					break
+				}
+				repo.Branch = branch
+			case "remote":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Remote = c.Val()
+			case "mirror_url":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				fallbackURL, _, err := parseURL(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid mirror_url: %v", err)
+				}
+				repo.FallbackURL = fallbackURL
+				// optional token of the mirror
+				if c.NextArg() {
+					token, err := expandEnv(c.Val())
+					if err != nil {
+						return nil, c.Errf("invalid mirror_url token: %v", err)
+					}
+					repo.FallbackToken = token
+				}
+			case "commit":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !isHash(c.Val()) {
+					return nil, c.Errf("invalid commit hash %v", c.Val())
+				}
+				repo.Commit = c.Val()
+			case "tag":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Tag = c.Val()
+			case "deploy_from_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.DeployFile = c.Val()
+			case "refspec":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !isRefSpec(c.Val()) {
+					return nil, c.Errf("invalid refspec %v", c.Val())
+				}
+				repo.RefSpec = c.Val()
+			case "tag_filter":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if _, err := tagFilter(c.Val()); err != nil {
+					return nil, c.Errf("invalid tag_filter %v: %v", c.Val(), err)
+				}
+				repo.TagFilter = c.Val()
 			case "auth_token":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				repo.Token = c.Val()
+				token, err := expandEnv(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid auth_token: %v", err)
+				}
+				repo.Token = token
+			case "auth_token_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.TokenFile = c.Val()
+			case "auth_user":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.User = c.Val()
+			case "auth_password":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				password, err := expandEnv(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid auth_password: %v", err)
+				}
+				repo.Password = password
+			case "key":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.KeyPath = c.Val()
+
+				// optional passphrase of the key
+				if c.NextArg() {
+					repo.KeyPassphrase = c.Val()
+				}
 			case "interval":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				t, _ := strconv.Atoi(c.Val())
-				if t > 0 {
-					repo.Interval = time.Duration(t) * time.Second
+				d, err := parseDuration(c.Val())
+				if err != nil || d == 0 {
+					return nil, c.Errf("invalid interval %v", c.Val())
+				}
+				// a negative interval disables periodic pulls
+				repo.Interval = d
+			case "min_interval":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid min_interval %v", c.Val())
+				}
+				repo.MinInterval = d
+			case "depth":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := strconv.Atoi(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid depth %v", c.Val())
+				}
+				repo.Depth = d
+			case "filter":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !isFilter(c.Val()) {
+					return nil, c.Errf("invalid filter %v", c.Val())
+				}
+				repo.Filter = c.Val()
+			case "max_size":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				size, err := strconv.ParseInt(c.Val(), 10, 64)
+				if err != nil || size < 1 {
+					return nil, c.Errf("invalid max_size %v", c.Val())
+				}
+				repo.MaxSize = size
+				// optional removal of the oversized clone
+				if c.NextArg() {
+					if c.Val() != "remove" {
+						return nil, c.ArgErr()
+					}
+					repo.RemoveOversized = true
+				}
+			case "unshallow":
+				repo.Unshallow = true
+			case "known_hosts":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.KnownHosts = c.Val()
+			case "insecure_skip_host_key_check":
+				repo.InsecureSkipHostKeyCheck = true
+			case "commit_header":
+				repo.SetCommitHeader = true
+			case "submodules":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if c.Val() == "off" {
+					repo.SubmoduleDepth = 0
+					break
+				}
+				d, err := strconv.Atoi(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid submodules depth %v", c.Val())
+				}
+				repo.SubmoduleDepth = gogit.SubmoduleRescursivity(d)
+			case "retries":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 0 {
+					return nil, c.Errf("invalid retries %v", c.Val())
+				}
+				repo.Retries = n
+			case "retry_backoff":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid retry_backoff %v", c.Val())
+				}
+				repo.RetryBackoff = d
+			case "retry_deadline":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid retry_deadline %v", c.Val())
+				}
+				repo.RetryDeadline = d
+			case "proxy":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if _, err := parseProxy(c.Val()); err != nil {
+					return nil, c.Errf("invalid proxy %v: %v", c.Val(), err)
+				}
+				repo.ProxyURL = c.Val()
+			case "timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid timeout %v", c.Val())
+				}
+				repo.Timeout = d
+			case "user_agent":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				repo.UserAgent = strings.Join(args, " ")
+			case "verify_key":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.VerifyKey = c.Val()
+			case "checkout_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.CheckoutDir = resolvePath(config.Root, c.Val())
+			case "sparse":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, dir := range args {
+					repo.Sparse = append(repo.Sparse, sparseDir(dir))
+				}
+			case "log":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.LogPath = c.Val()
+			case "log_format":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !isLogFormat(c.Val()) {
+					return nil, c.Errf("invalid log_format %v", c.Val())
+				}
+				repo.LogFormat = c.Val()
+			case "log_level":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				level, ok := parseLogLevel(c.Val())
+				if !ok {
+					return nil, c.Errf("invalid log_level %v", c.Val())
+				}
+				repo.LogLevel = level
+			case "deploy_marker":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.DeployMarker = c.Val()
+			case "jitter":
+				repo.Jitter = true
+			case "clean":
+				repo.Clean = true
+			case "pull_on_start":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "on":
+					repo.SkipStartupPull = false
+				case "off":
+					repo.SkipStartupPull = true
+				default:
+					return nil, c.Errf("invalid pull_on_start %v", c.Val())
+				}
+			case "allow_rewind":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "on":
+					repo.AllowRewind = true
+				case "off":
+					repo.AllowRewind = false
+				default:
+					return nil, c.Errf("invalid allow_rewind %v", c.Val())
 				}
+			case "best_effort":
+				repo.BestEffort = true
+			case "fetch_only":
+				repo.FetchOnly = true
+			case "push":
+				repo.Push = true
+				// optional message of the commits
+				if c.NextArg() {
+					repo.PushMessage = c.Val()
+				}
+			case "mirror":
+				repo.Mirror = true
 			case "hook":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -145,6 +691,55 @@ func parse(c *caddy.Controller) (Git, error) {
 				if c.NextArg() {
 					repo.Hook.Secret = c.Val()
 				}
+			case "name":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Name = c.Val()
+			case "pull_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.PullPath = c.Val()
+			case "pull_token":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				token, err := expandEnv(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid pull_token: %v", err)
+				}
+				repo.PullToken = token
+			case "status_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.StatusPath = c.Val()
+			case "health_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.HealthPath = c.Val()
+			case "metrics":
+				repo.Metrics = true
+				// optional path to serve the metrics on
+				if c.NextArg() {
+					repo.MetricsPath = c.Val()
+				}
+			case "hook_allow_ip":
+				ips, err := ipArgs(c)
+				if err != nil {
+					return nil, err
+				}
+				repo.Hook.AllowIPs = append(repo.Hook.AllowIPs, ips...)
+			case "hook_trusted_proxy":
+				ips, err := ipArgs(c)
+				if err != nil {
+					return nil, err
+				}
+				repo.Hook.TrustedProxies = append(repo.Hook.TrustedProxies, ips...)
+			case "hook_async":
+				repo.Hook.Async = true
 			case "hook_type":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -168,21 +763,224 @@ func parse(c *caddy.Controller) (Git, error) {
 				command := c.Val()
 				args := c.RemainingArgs()
 				repo.Then = append(repo.Then, NewLongThen(command, args...))
+			case "then_once":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.ThenOnce = append(repo.ThenOnce, NewThen(command, args...))
+			case "then_if_changed":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if _, err := path.Match(args[0], ""); err != nil {
+					return nil, c.Errf("invalid then_if_changed pattern %v", args[0])
+				}
+				repo.Then = append(repo.Then, NewChangedThen(args[0], args[1], args[2:]...))
+			case "then_script":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Then = append(repo.Then, NewScriptThen(c.Val()))
+			case "then_shell":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if _, err := gos.LookPath(c.Val()); err != nil {
+					return nil, c.Errf("invalid then_shell %v: %v", c.Val(), err)
+				}
+				repo.ThenShell = c.Val()
+			case "max_concurrent_clones":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return nil, c.Errf("invalid max_concurrent_clones %v", c.Val())
+				}
+				repo.MaxConcurrentClones = n
+			case "then_policy":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "continue":
+					repo.ThenContinue = true
+				case "halt":
+					repo.ThenContinue = false
+				default:
+					return nil, c.Errf("invalid then_policy %v", c.Val())
+				}
+			case "then_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d < 0 {
+					return nil, c.Errf("invalid then_timeout %v", c.Val())
+				}
+				repo.ThenTimeout = d
+			case "then_debounce":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d, err := parseDuration(c.Val())
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid then_debounce %v", c.Val())
+				}
+				repo.ThenDebounce = d
+			case "before":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.Before = append(repo.Before, NewThen(command, args...))
+			case "before_policy":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "changed":
+					repo.BeforeAlways = false
+				case "always":
+					repo.BeforeAlways = true
+				default:
+					return nil, c.Errf("invalid before_policy %v", c.Val())
+				}
+			case "on_error":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.OnError = append(repo.OnError, NewThen(command, args...))
+			case "then_env":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if strings.Index(c.Val(), "=") <= 0 {
+					return nil, c.Errf("invalid then_env %v", c.Val())
+				}
+				repo.ThenEnv = append(repo.ThenEnv, c.Val())
 			default:
 				return nil, c.ArgErr()
 			}
 		}
 
+		// relative clone paths are in base_dir, the site root by default
+		base := config.Root
+		if repo.BaseDir != "" {
+			base = repo.BaseDir
+		}
+		repo.Path = resolvePath(base, clonePath)
+
+		// then_shell applies to the then_script commands
+		// configured before it as well
+		for _, then := range repo.Then {
+			if script, ok := then.(*scriptCmd); ok {
+				script.shell = repo.ThenShell
+			}
+		}
+
 		// if repo is not specified, return error
 		if repo.URL == "" {
 			return nil, c.ArgErr()
 		}
 		// validate repo url
-		if repoURL, err := parseURL(string(repo.URL)); err != nil {
+		if repoURL, u, err := parseURL(string(repo.URL)); err != nil {
 			return nil, err
 		} else {
-			repo.URL = RepoURL(repoURL.String())
-			repo.Host = repoURL.Hostname()
+			repo.URL = repoURL
+			repo.Host = u.Hostname()
+		}
+
+		// the pulls sooner than min_interval would be ignored
+		if repo.Interval > 0 && repo.Interval < repo.MinInterval {
+			Logger().Printf("Warning: interval %v of %v is less than min_interval %v, using %v.\n",
+				repo.Interval, repo.label(), repo.MinInterval, repo.MinInterval)
+			repo.Interval = repo.MinInterval
+		}
+
+		// go-git fetches all the blobs, the clone is full
+		if repo.Filter != "" {
+			Logger().Printf("Warning: filter %v of %v is not supported, cloning all the files; depth and sparse reduce the clone instead.\n",
+				repo.Filter, repo.label())
+		}
+
+		// go-git only supports proxies and user agents for http
+		if repo.ProxyURL != "" && (repo.URL.isSSH() || repo.URL.isAnonymous()) {
+			return nil, c.Errf("proxy is not supported for url %v", repo.URL)
+		}
+		if repo.UserAgent != "" && (repo.URL.isSSH() || repo.URL.isAnonymous()) {
+			return nil, c.Errf("user_agent is not supported for url %v", repo.URL)
+		}
+		if (repo.KnownHosts != "" || repo.InsecureSkipHostKeyCheck) && !repo.URL.isSSH() {
+			return nil, c.Errf("known_hosts and insecure_skip_host_key_check are only supported for ssh urls")
+		}
+		if repo.KnownHosts != "" && repo.InsecureSkipHostKeyCheck {
+			return nil, c.Errf("known_hosts is not supported with insecure_skip_host_key_check")
+		}
+
+		if repo.Hook.URL != "" && repo.Hook.Secret == "" {
+			// auto detected hooks may be of any type
+			if repo.Hook.Type == "" {
+				return nil, c.Errf("hook %v requires a secret, or a hook_type not validated by a secret", repo.Hook.URL)
+			}
+			if h, ok := handlers[repo.Hook.Type]; ok && h.RequiresSecret() {
+				return nil, c.Errf("hook type %v requires a secret", repo.Hook.Type)
+			}
+		}
+
+		if repo.PullPath != "" && repo.PullToken == "" {
+			return nil, c.Errf("pull_path %v requires a pull_token", repo.PullPath)
+		}
+
+		if repo.CheckoutDir != "" && (repo.Mirror || repo.FetchOnly) {
+			return nil, c.Errf("checkout_dir is not supported with mirror and fetch_only")
+		}
+
+		if repo.Tag != "" && (repo.Commit != "" || repo.followsTags()) {
+			return nil, c.Errf("tag %v is not supported with commit and branch %v", repo.Tag, repo.Branch)
+		}
+		if repo.Push && (repo.Mirror || repo.FetchOnly || repo.CheckoutDir != "" || len(repo.Sparse) > 0 || repo.detached()) {
+			return nil, c.Errf("push is not supported with mirror, fetch_only, checkout_dir, sparse and detached checkouts")
+		}
+		if repo.Push && repo.Interval <= 0 {
+			return nil, c.Errf("push requires an interval")
+		}
+		if repo.DeployFile != "" && (repo.Commit != "" || repo.Tag != "" || repo.followsTags()) {
+			return nil, c.Errf("deploy_from_file is not supported with commit, tag and branch %v", repo.Branch)
+		}
+		if repo.RefSpec != "" && (repo.Mirror || repo.FetchOnly || repo.Commit != "" || repo.Tag != "" || repo.followsTags() || repo.DeployFile != "") {
+			return nil, c.Errf("refspec is not supported with mirror, fetch_only, commit, tag, deploy_from_file and branch %v", repo.Branch)
+		}
+		if repo.Unshallow && repo.Depth == 0 {
+			return nil, c.Errf("unshallow requires a depth")
+		}
+		if repo.TagFilter != "" && !repo.followsTags() {
+			return nil, c.Errf("tag_filter requires branch %v or a tag pattern", latestTag)
+		}
+		if pattern, ok := repo.tagPattern(); ok {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, c.Errf("invalid tag pattern %v", pattern)
+			}
+		}
+
+		if len(repo.Sparse) > 0 && (repo.Mirror || repo.FetchOnly || repo.CheckoutDir != "" || repo.detached()) {
+			return nil, c.Errf("sparse is not supported with mirror, fetch_only, checkout_dir, commit and tags")
+		}
+
+		// webhooks are dispatched by exact path,
+		// a hook url can only be used by one repo
+		if repo.Hook.URL != "" {
+			for _, r := range git {
+				if r.Hook.URL == repo.Hook.URL {
+					return nil, c.Errf("hook url %v is already used by %v", repo.Hook.URL, r.URL)
+				}
+			}
 		}
 
 		// prepare repo for use
@@ -196,23 +994,117 @@ func parse(c *caddy.Controller) (Git, error) {
 	return git, nil
 }
 
-// parseURL validates if repoUrl is a valid git url.
-func parseURL(repoURL string) (*url.URL, error) {
+// expandEnv returns the value of the environment variable VAR if s is
+// {env.VAR}, s otherwise. {env.VAR:default} defaults to default if the
+// variable is empty, an error is returned otherwise.
+func expandEnv(s string) (string, error) {
+	if !strings.HasPrefix(s, "{env.") || !strings.HasSuffix(s, "}") {
+		return s, nil
+	}
+	name := s[len("{env.") : len(s)-1]
+	var def string
+	var hasDefault bool
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, def, hasDefault = name[:i], name[i+1:], true
+	}
+	if name == "" {
+		return "", fmt.Errorf("missing environment variable name in %v", s)
+	}
+	v := os.Getenv(name)
+	if v == "" && hasDefault {
+		return def, nil
+	}
+	if v == "" {
+		return "", fmt.Errorf("environment variable %v is empty", name)
+	}
+	return v, nil
+}
+
+// isHash checks if s is a full commit hash.
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// resolvePath returns path relative to base, or path if it is absolute.
+func resolvePath(base, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(base, path)
+}
+
+// isFilter checks if s is a partial clone filter of git:
+// blob:none, blob:limit=<n>[kmg] or tree:<depth>.
+func isFilter(s string) bool {
+	switch {
+	case s == "blob:none":
+		return true
+	case strings.HasPrefix(s, "blob:limit="):
+		limit := strings.TrimPrefix(s, "blob:limit=")
+		if n := len(limit); n > 0 && strings.ContainsAny(limit[n-1:], "kmgKMG") {
+			limit = limit[:n-1]
+		}
+		_, err := strconv.ParseUint(limit, 10, 64)
+		return err == nil
+	case strings.HasPrefix(s, "tree:"):
+		_, err := strconv.ParseUint(strings.TrimPrefix(s, "tree:"), 10, 64)
+		return err == nil
+	}
+	return false
+}
+
+// parseDuration parses s as a duration e.g. 5m, or a number of seconds.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	t, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t) * time.Second, nil
+}
+
+// scpURL matches the scp-like syntax of ssh urls e.g. git@github.com:user/repo.
+var scpURL = regexp.MustCompile(`^[^@/:]+@[^@/:]+:`)
+
+// parseURL validates if repoUrl is a valid git url. It returns the url
+// with its scheme, scp-like urls e.g. git@github.com:user/repo becoming
+// ssh://git@github.com:user/repo, and the parsed url.
+func parseURL(repoURL string) (RepoURL, *url.URL, error) {
 	// scheme
 	urlParts := strings.Split(repoURL, "://")
 	switch {
 	case strings.HasPrefix(repoURL, "https://"):
 	case strings.HasPrefix(repoURL, "http://"):
 	case strings.HasPrefix(repoURL, "ssh://"):
+	case strings.HasPrefix(repoURL, "git://"):
+	case strings.HasPrefix(repoURL, "file://"):
 	case len(urlParts) > 1:
-		return nil, fmt.Errorf("invalid url scheme %s. If url contains port, scheme is required", urlParts[0])
+		return "", nil, fmt.Errorf("invalid url scheme %s. If url contains port, scheme is required", urlParts[0])
+	case scpURL.MatchString(repoURL):
+		repoURL = "ssh://" + repoURL
 	default:
 		repoURL = "https://" + repoURL
 	}
 
+	// the path of scp-like urls is separated by a colon
+	// instead of a slash, which url.Parse takes for a port
+	userHost, path, scp := RepoURL(repoURL).scp()
+	if scp {
+		repoURL = "ssh://" + userHost + "/" + strings.TrimPrefix(path, "/")
+	}
+
 	u, err := url.Parse(repoURL)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	if scp {
+		return RepoURL("ssh://" + userHost + ":" + path), u, nil
 	}
-	return u, nil
+	return RepoURL(u.String()), u, nil
 }
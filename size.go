@@ -0,0 +1,55 @@
+package git
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// dirSize returns the total size of the files in dir and its
+// subdirectories. Symbolic links are not followed.
+func dirSize(dir string) (int64, error) {
+	entries, err := gos.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			size += entry.Size()
+			continue
+		}
+		n, err := dirSize(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// checkSize checks that r.Path, the history included, doesn't exceed
+// r.MaxSize. The clone is removed if it does and r.RemoveOversized
+// is set, to be cloned again by the next pull.
+func (r *Repo) checkSize() error {
+	if r.MaxSize <= 0 {
+		return nil
+	}
+	size, err := dirSize(r.Path)
+	if err != nil {
+		return fmt.Errorf("cannot measure the size of %v: %v", r.Path, err)
+	}
+	if size <= r.MaxSize {
+		return nil
+	}
+
+	err = fmt.Errorf("%v is %v bytes, exceeding max_size %v", r.Path, size, r.MaxSize)
+	if !r.RemoveOversized {
+		return err
+	}
+	if removeErr := gos.RemoveAll(r.Path); removeErr != nil {
+		return mergeErrors(err, removeErr)
+	}
+	r.pulled = false
+	r.lastCommit = ""
+	return fmt.Errorf("%v, removed", err)
+}
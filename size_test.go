@@ -0,0 +1,62 @@
+package git
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestMaxSize(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	tests := []struct {
+		maxSize   int64
+		remove    bool
+		shouldErr bool
+	}{
+		{0, false, false},
+		{4096, false, false},
+		{2048, false, true},
+		{2048, true, true},
+	}
+	for i, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		// the fake os reports 3072 bytes
+		gittest.SetDir(dir, "index.html", "large.bin", "huge.bin")
+		defer gittest.SetDir(dir)
+
+		then := &countThen{}
+		repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+		repo.MaxSize = test.maxSize
+		repo.RemoveOversized = test.remove
+		repo.Then = []Then{then}
+
+		err := repo.Pull()
+		if !test.shouldErr {
+			check(t, err)
+			if then.n != 1 {
+				t.Errorf("Test %v: expected then executed, found %v executions", i, then.n)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), "exceeding max_size") {
+			t.Errorf("Test %v: expected max_size error found %v", i, err)
+		}
+		if then.n != 0 {
+			t.Errorf("Test %v: expected then not executed, found %v executions", i, then.n)
+		}
+		// a removed clone is cloned again by the next pull
+		if repo.pulled == test.remove {
+			t.Errorf("Test %v: expected pulled %v after the removal %v, found %v", i, !test.remove, test.remove, repo.pulled)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package git
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// sparseDir normalizes a directory of a sparse checkout
+// to a slash separated path relative to the repository root.
+func sparseDir(dir string) string {
+	return strings.Trim(path.Clean("/"+dir), "/")
+}
+
+// inSparse checks if the file is in one of the directories
+// of the sparse checkout of r.
+func (r *Repo) inSparse(name string) bool {
+	for _, dir := range r.Sparse {
+		if dir == "" || name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sparsePull fetches the remote branch then writes the files of its
+// directories listed in r.Sparse to the worktree. go-git has no sparse
+// checkout, the index is left empty and the branch is moved to the
+// checked out commit.
+func (r *Repo) sparsePull(ctx context.Context) error {
+	gr, err := r.fetchOrClone(ctx)
+	if err != nil {
+		if isMissingRef(err) {
+			return r.branchNotFound(r.Branch)
+		}
+		return err
+	}
+
+	ref, err := gr.Reference(plumbing.NewRemoteReferenceName(r.remoteName(), r.Branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return r.branchNotFound(r.Branch)
+	}
+	if err != nil {
+		return err
+	}
+	commit, err := gr.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+
+	// files of the previously checked out commit which are
+	// missing from the new one are removed
+	var previous *object.Commit
+	if r.pulled {
+		if head, err := gr.Head(); err == nil {
+			previous, _ = gr.CommitObject(head.Hash())
+		}
+	}
+
+	if err := r.checkHead(gr, commit.Hash); err != nil {
+		return err
+	}
+	if commit.Hash.String() != r.lastCommit {
+		r.logf(LogVerbose, "Checking out %v of commit %v of %v.\n", strings.Join(r.Sparse, ", "), commit.Hash, r.label())
+		if err := exportFiles(commit, previous, r.Path, r.inSparse); err != nil {
+			return err
+		}
+	}
+
+	if err := checkoutSparseHead(gr, r.Branch, commit.Hash); err != nil {
+		return err
+	}
+	return r.pulledHead(ctx, gr)
+}
+
+// checkoutSparseHead points HEAD to branch, at hash.
+func checkoutSparseHead(gr *git.Repository, branch string, hash plumbing.Hash) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	if err := gr.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return err
+	}
+	return gr.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name))
+}
@@ -0,0 +1,62 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestSparse(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "README.md", "readme")
+	remote.commit(t, "site/index.html", "first")
+	remote.commit(t, "site/old.html", "old")
+	remote.commit(t, "docs/index.md", "docs")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	repo.Sparse = []string{"site"}
+
+	content := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	checkSparse := func(files map[string]string) {
+		t.Helper()
+		for name, expected := range files {
+			if s := content(name); s != expected {
+				t.Errorf("Expected %v to be %q found %q", name, expected, s)
+			}
+		}
+		for _, name := range []string{"README.md", "docs"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("Expected %v not checked out found %v", name, err)
+			}
+		}
+	}
+
+	check(t, repo.Pull())
+	checkSparse(map[string]string{"site/index.html": "first", "site/old.html": "old"})
+
+	remote.commit(t, "site/index.html", "second")
+	remote.commit(t, "docs/index.md", "more docs")
+	remote.remove(t, "site/old.html")
+	last := remote.commit(t, "README.md", "new readme")
+	check(t, repo.Pull())
+	checkSparse(map[string]string{"site/index.html": "second", "site/old.html": ""})
+	if repo.lastCommit != last {
+		t.Errorf("Expected commit %v found %v", last, repo.lastCommit)
+	}
+}
@@ -0,0 +1,107 @@
+package git
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// RepoStatus is the state of a repository as reported
+// by the status endpoint.
+type RepoStatus struct {
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Branch     string    `json:"branch"`
+	LastPull   time.Time `json:"last_pull"`
+	LastCommit string    `json:"last_commit"`
+	LatestTag  string    `json:"latest_tag,omitempty"`
+	Failed     bool      `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+	ErrorTime  time.Time `json:"error_time"`
+}
+
+// setStatus records the state of r after a pull
+// which returned err. r must be locked.
+func (r *Repo) setStatus(err error) {
+	r.lastError = err
+	if err != nil {
+		r.lastErrorTime = time.Now()
+	} else {
+		r.lastErrorTime = time.Time{}
+	}
+
+	status := RepoStatus{
+		Name:       r.redact(r.publicName()),
+		URL:        r.redact(r.URL.public()),
+		Branch:     r.Branch,
+		LastPull:   r.lastPull,
+		LastCommit: r.lastCommit,
+		LatestTag:  r.latestTag,
+		Failed:     r.lastError != nil,
+	}
+	if r.lastError != nil {
+		status.Error = r.redact(r.lastError.Error())
+		status.ErrorTime = r.lastErrorTime
+	}
+
+	r.statusMu.Lock()
+	r.status = status
+	r.statusMu.Unlock()
+}
+
+// Status returns the state of r recorded after the last pull.
+// It doesn't wait for a running pull to complete.
+func (r *Repo) Status() RepoStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	if r.status.URL == "" {
+		// not pulled yet
+		return RepoStatus{Name: r.redact(r.publicName()), URL: r.redact(r.URL.public()), Branch: r.Branch}
+	}
+	return r.status
+}
+
+// redact removes the credentials of r from s.
+func (r *Repo) redact(s string) string {
+	// the errors mention the url with its user
+	if public := r.URL.public(); public != r.URL.String() {
+		s = strings.Replace(s, r.URL.String(), public, -1)
+	}
+	for _, secret := range []string{r.Token, r.Password, r.KeyPassphrase, r.FallbackToken} {
+		if secret != "" {
+			s = strings.Replace(s, secret, "REDACTED", -1)
+		}
+	}
+	return s
+}
+
+// StatusHandler is middleware serving the state of repos as JSON.
+type StatusHandler struct {
+	Path  string
+	Repos []*Repo
+	Next  httpserver.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (h StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != h.Path {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	statuses := make([]RepoStatus, len(h.Repos))
+	for i, repo := range h.Repos {
+		statuses[i] = repo.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,89 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// updateSubmodules checks out the submodules of gr recorded in its HEAD,
+// recursing up to r.SubmoduleDepth levels. The submodules are updated
+// by r rather than by go-git so the credentials of r are only sent to
+// the submodules hosted with r.
+func (r *Repo) updateSubmodules(ctx context.Context, gr *git.Repository) error {
+	if r.SubmoduleDepth == git.NoRecurseSubmodules {
+		return nil
+	}
+	auth, err := r.auth()
+	if err != nil {
+		return err
+	}
+	return r.updateSubmodulesOf(ctx, gr, auth, r.SubmoduleDepth)
+}
+
+// updateSubmodulesOf updates the submodules of gr and their own
+// submodules up to depth levels.
+func (r *Repo) updateSubmodulesOf(ctx context.Context, gr *git.Repository, auth transport.AuthMethod, depth git.SubmoduleRescursivity) error {
+	w, err := gr.Worktree()
+	if err != nil {
+		return err
+	}
+	submodules, err := w.Submodules()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range submodules {
+		opts := &git.SubmoduleUpdateOptions{
+			Init: true,
+			Auth: r.submoduleAuth(s.Config().URL, auth),
+		}
+		if err := s.UpdateContext(ctx, opts); err != nil {
+			return fmt.Errorf("updating submodule %v failed: %v", s.Config().Name, err)
+		}
+		if depth <= 1 {
+			continue
+		}
+		sr, err := s.Repository()
+		if err != nil {
+			return err
+		}
+		if err := r.updateSubmodulesOf(ctx, sr, auth, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submoduleAuth returns auth if the submodule url is on the host of r
+// with the same kind of authentication, ssh or http, nil otherwise.
+// Relative urls are resolved against the url of r.
+func (r *Repo) submoduleAuth(submoduleURL string, auth transport.AuthMethod) transport.AuthMethod {
+	if strings.HasPrefix(submoduleURL, "./") || strings.HasPrefix(submoduleURL, "../") {
+		return auth
+	}
+	host, ssh := urlHost(submoduleURL)
+	repoHost, repoSSH := urlHost(r.URL.Val())
+	if host != repoHost || ssh != repoSSH {
+		return nil
+	}
+	return auth
+}
+
+// urlHost returns the host of the git url s, and whether s
+// is an ssh url. Local paths have no host.
+func urlHost(s string) (host string, ssh bool) {
+	if !strings.Contains(s, "://") && scpURL.MatchString(s) {
+		userHost := s[:strings.Index(s, ":")]
+		return userHost[strings.Index(userHost, "@")+1:], true
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false
+	}
+	return u.Hostname(), u.Scheme == "ssh"
+}
@@ -0,0 +1,127 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+// recordingTransport serves local repositories like the go-git server,
+// recording the authentication used for each host.
+type recordingTransport struct {
+	transport.Transport
+	auths map[string]transport.AuthMethod
+	sync.Mutex
+}
+
+func (r *recordingTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	r.Lock()
+	r.auths[ep.Host] = auth
+	r.Unlock()
+	return r.Transport.NewUploadPackSession(ep, auth)
+}
+
+// addSubmodule commits the submodule url at path, checked out at commit.
+// The submodules added before are kept.
+func (r *testRemote) addSubmodule(t *testing.T, path, url, commit string) {
+	name := filepath.Join(r.dir, ".gitmodules")
+	gitmodules, _ := ioutil.ReadFile(name)
+	gitmodules = append(gitmodules, "[submodule \""+path+"\"]\n\tpath = "+path+"\n\turl = "+url+"\n"...)
+	check(t, ioutil.WriteFile(name, gitmodules, os.FileMode(0644)))
+
+	w, err := r.repo.Worktree()
+	check(t, err)
+	_, err = w.Add(".gitmodules")
+	check(t, err)
+
+	idx, err := r.repo.Storer.Index()
+	check(t, err)
+	idx.Entries = append(idx.Entries, &index.Entry{
+		Name: path,
+		Hash: plumbing.NewHash(commit),
+		Mode: filemode.Submodule,
+	})
+	check(t, r.repo.Storer.SetIndex(idx))
+
+	_, err = w.Commit("add submodule "+path, &gogit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	check(t, err)
+}
+
+func TestSubmoduleAuth(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	rec := &recordingTransport{Transport: server.DefaultServer, auths: make(map[string]transport.AuthMethod)}
+	client.InstallProtocol("rec", rec)
+	defer client.InstallProtocol("rec", nil)
+
+	private := newRemote(t)
+	defer os.RemoveAll(private.dir)
+	privateHash := private.commit(t, "private.html", "private")
+
+	public := newRemote(t)
+	defer os.RemoveAll(public.dir)
+	publicHash := public.commit(t, "public.html", "public")
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+	remote.addSubmodule(t, "private", "rec://example.com"+string(private.URL()), privateHash)
+	remote.addSubmodule(t, "public", "rec://other.example.com"+string(public.URL()), publicHash)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: "rec://example.com" + remote.URL(), Path: dir, Token: "secret-token"})
+	repo.SubmoduleDepth = gogit.DefaultSubmoduleRecursionDepth
+	check(t, repo.Pull())
+
+	for _, name := range []string{"private/private.html", "public/public.html"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected submodule file %v checked out found %v", name, err)
+		}
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+	if auth, ok := rec.auths["example.com"].(*http.BasicAuth); !ok || auth.Password != "secret-token" {
+		t.Errorf("Expected token sent to the submodule on the same host found %v", rec.auths["example.com"])
+	}
+	if auth, ok := rec.auths["other.example.com"]; !ok || auth != nil {
+		t.Errorf("Expected no credentials sent to the submodule on another host found %v", auth)
+	}
+}
+
+func TestURLHost(t *testing.T) {
+	for i, test := range []struct {
+		url  string
+		host string
+		ssh  bool
+	}{
+		{"https://github.com/user/repo.git", "github.com", false},
+		{"https://user@github.com:8443/user/repo.git", "github.com", false},
+		{"ssh://git@github.com:2222/user/repo.git", "github.com", true},
+		{"git@github.com:user/repo.git", "github.com", true},
+		{"/var/git/repo.git", "", false},
+	} {
+		host, ssh := urlHost(test.url)
+		if host != test.host || ssh != test.ssh {
+			t.Errorf("Test %v: expected host %v and ssh %v found %v and %v", i, test.host, test.ssh, host, ssh)
+		}
+	}
+}
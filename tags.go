@@ -0,0 +1,251 @@
+package git
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// semver is a semantic version as found in tag names e.g. v1.2.3.
+type semver struct {
+	major, minor, patch int
+	pre                 string // pre-release e.g. rc.1
+}
+
+// parseSemver parses the tag name as a semantic version.
+// The leading v and build metadata are optional.
+func parseSemver(tag string) (semver, bool) {
+	var v semver
+
+	s := strings.TrimPrefix(strings.TrimPrefix(tag, "v"), "V")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = s[i+1:]
+		if v.pre == "" {
+			return v, false
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || strings.HasPrefix(part, "+") {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// less reports whether v precedes w.
+func (v semver) less(w semver) bool {
+	switch {
+	case v.major != w.major:
+		return v.major < w.major
+	case v.minor != w.minor:
+		return v.minor < w.minor
+	case v.patch != w.patch:
+		return v.patch < w.patch
+	case v.pre == "" || w.pre == "":
+		// a pre-release precedes the release
+		return v.pre != "" && w.pre == ""
+	}
+	return lessPrerelease(v.pre, w.pre)
+}
+
+// lessPrerelease reports whether the pre-release a precedes b, comparing
+// their dot separated identifiers in turn as semver 2.0.0 specifies:
+// numerically if both are numeric, numeric ones first, else in ASCII
+// order. A pre-release with fewer identifiers otherwise precedes.
+func lessPrerelease(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		if x == y {
+			continue
+		}
+		xNum, yNum := isNumeric(x), isNumeric(y)
+		switch {
+		case xNum && yNum:
+			// compared as strings to avoid overflows
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			return x < y
+		case xNum != yNum:
+			return xNum
+		}
+		return x < y
+	}
+	return len(as) < len(bs)
+}
+
+// isNumeric checks if s is a non empty string of digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// highestSemverTag returns the tag with the highest semantic version
+// among tags. Tags that are not semantic versions are ignored.
+// An empty string is returned if there is none.
+func highestSemverTag(tags []string) string {
+	var highest string
+	var hv semver
+	for _, tag := range tags {
+		v, ok := parseSemver(tag)
+		if !ok {
+			continue
+		}
+		if highest == "" || hv.less(v) {
+			highest, hv = tag, v
+		}
+	}
+	return highest
+}
+
+// tagPattern returns the pattern of the tags followed by r, if its branch
+// is {latest} or a glob of tag names such as v1.*. Glob characters are
+// not allowed in branch names.
+func (r *Repo) tagPattern() (string, bool) {
+	if r.Branch == latestTag {
+		return "*", true
+	}
+	if strings.ContainsAny(r.Branch, "*?[") {
+		return r.Branch, true
+	}
+	return "", false
+}
+
+// tagFilter returns the function matching the tags
+// allowed by filter, a glob or a regexp between slashes.
+func tagFilter(filter string) (func(string) bool, error) {
+	if filter == "" {
+		return func(string) bool { return true }, nil
+	}
+	if len(filter) > 1 && strings.HasPrefix(filter, "/") && strings.HasSuffix(filter, "/") {
+		re, err := regexp.Compile(filter[1 : len(filter)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(filter, ""); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(filter, name)
+		return ok
+	}, nil
+}
+
+// followsTags checks if r checks out the latest of its tags
+// rather than a branch.
+func (r *Repo) followsTags() bool {
+	_, ok := r.tagPattern()
+	return ok
+}
+
+// checkoutLatestTag checks out the tag with the highest semantic version
+// among the tags matching the tag pattern and the tag filter of r.
+func (r *Repo) checkoutLatestTag(gr *git.Repository) error {
+	pattern, _ := r.tagPattern()
+	filter, err := tagFilter(r.TagFilter)
+	if err != nil {
+		return err
+	}
+
+	iter, err := gr.Tags()
+	if err != nil {
+		return err
+	}
+
+	refs := make(map[string]*plumbing.Reference)
+	var names []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if ok, _ := path.Match(pattern, name); !ok || !filter(name) {
+			return nil
+		}
+		refs[name] = ref
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tag := highestSemverTag(names)
+	if tag == "" {
+		return fmt.Errorf("no semver tag matching %v found in %v", pattern, r.URL)
+	}
+
+	hash, err := tagCommit(gr, refs[tag])
+	if err != nil {
+		return err
+	}
+	if err := r.checkoutCommit(gr, hash.String()); err != nil {
+		return err
+	}
+
+	if tag != r.latestTag {
+		Logger().Printf("Checked out latest tag %v.\n", tag)
+	}
+	r.latestTag = tag
+	return nil
+}
+
+// checkoutTag checks out the commit of the pinned tag r.Tag.
+func (r *Repo) checkoutTag(gr *git.Repository) error {
+	ref, err := gr.Tag(r.Tag)
+	if err == git.ErrTagNotFound {
+		return fmt.Errorf("tag %v not found in %v", r.Tag, r.URL)
+	}
+	if err != nil {
+		return err
+	}
+
+	hash, err := tagCommit(gr, ref)
+	if err != nil {
+		return err
+	}
+	return r.checkoutCommit(gr, hash.String())
+}
+
+// tagCommit returns the hash of the commit the tag ref points to.
+// Annotated tags are resolved to their target commit.
+func tagCommit(gr *git.Repository, ref *plumbing.Reference) (plumbing.Hash, error) {
+	tag, err := gr.TagObject(ref.Hash())
+	switch err {
+	case nil:
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return commit.Hash, nil
+	case plumbing.ErrObjectNotFound:
+		// lightweight tag
+		return ref.Hash(), nil
+	}
+	return plumbing.ZeroHash, err
+}
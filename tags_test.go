@@ -0,0 +1,206 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestHighestSemverTag(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"latest", "nightly", "release"}, ""},
+		{[]string{"v1.0.0", "v1.2.0", "v1.1.9"}, "v1.2.0"},
+		{[]string{"v1.9.0", "v1.10.0", "v1.2.0"}, "v1.10.0"},
+		{[]string{"1.0.0", "v2.0.0", "V1.5.0"}, "v2.0.0"},
+		{[]string{"v2.0.0-rc.1", "v1.9.9", "v2.0.0-beta"}, "v2.0.0-rc.1"},
+		{[]string{"v2.0.0-rc.1", "v2.0.0", "v2.0.0+build.5"}, "v2.0.0"},
+		{[]string{"v1.0.0-rc.2", "v1.0.0-rc.10", "v1.0.0-rc.9"}, "v1.0.0-rc.10"},
+		{[]string{"v1.0.0-alpha.beta", "v1.0.0-alpha.1", "v1.0.0-alpha"}, "v1.0.0-alpha.beta"},
+		{[]string{"v1.0.0-rc.1.1", "v1.0.0-rc.1"}, "v1.0.0-rc.1.1"},
+		{[]string{"v1.0.0-2", "v1.0.0-11", "v1.0.0-beta"}, "v1.0.0-beta"},
+		{[]string{"v1.0.0-rc.99999999999999999999", "v1.0.0-rc.100000000000000000000"}, "v1.0.0-rc.100000000000000000000"},
+		{[]string{"v1.0.0", "v3", "v4.0", "v5.0.0.0", "v6.x.0", "build-100", "v2.0.0-"}, "v1.0.0"},
+	}
+
+	for i, test := range tests {
+		if tag := highestSemverTag(test.tags); tag != test.expected {
+			t.Errorf("Test %v: Expected %v found %v", i, test.expected, tag)
+		}
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	first := remote.commit(t, "index.html", "first")
+	remote.tag(t, "v1.0.0", first)
+	second := remote.commit(t, "index.html", "second")
+	remote.tag(t, "v1.1.0", second)
+	remote.tag(t, "nightly", remote.commit(t, "index.html", "nightly"))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Branch: latestTag})
+	repo.MinInterval = 0
+
+	check(t, repo.Pull())
+	if repo.latestTag != "v1.1.0" || repo.lastCommit != second {
+		t.Errorf("Expected v1.1.0 at %v found %v at %v", second, repo.latestTag, repo.lastCommit)
+	}
+
+	// a newer tag appears
+	third := remote.commit(t, "index.html", "third")
+	remote.tag(t, "v2.0.0", third)
+
+	check(t, repo.Pull())
+	if repo.latestTag != "v2.0.0" || repo.lastCommit != third {
+		t.Errorf("Expected v2.0.0 at %v found %v at %v", third, repo.latestTag, repo.lastCommit)
+	}
+}
+
+func TestTagPattern(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	first := remote.commit(t, "index.html", "first")
+	remote.tag(t, "v1.0.0", first)
+	remote.tag(t, "v2.0.0-rc.1", remote.commit(t, "index.html", "rc"))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Branch: "v1.*"})
+	repo.MinInterval = 0
+	var pulled []string
+	repo.OnPull = func(oldCommit, newCommit string) {
+		pulled = append(pulled, newCommit)
+	}
+
+	check(t, repo.Pull())
+	if repo.latestTag != "v1.0.0" || repo.lastCommit != first {
+		t.Errorf("Expected v1.0.0 at %v found %v at %v", first, repo.latestTag, repo.lastCommit)
+	}
+
+	// new releases appear between the interval pulls,
+	// only the matching one is checked out
+	remote.tag(t, "v2.0.0", remote.commit(t, "index.html", "v2"))
+	second := remote.commit(t, "index.html", "v1.1")
+	remote.annotatedTag(t, "v1.1.0", second)
+
+	check(t, repo.Pull())
+	if repo.latestTag != "v1.1.0" || repo.lastCommit != second {
+		t.Errorf("Expected v1.1.0 at %v found %v at %v", second, repo.latestTag, repo.lastCommit)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	check(t, err)
+	if string(data) != "v1.1" {
+		t.Errorf("Expected v1.1.0 checked out found %q", data)
+	}
+	if len(pulled) != 2 || pulled[1] != second {
+		t.Errorf("Expected pull of the new release found %v", pulled)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	release := remote.commit(t, "index.html", "release")
+	remote.tag(t, "v1.2.3", release)
+	remote.tag(t, "v1.3.0-rc.1", remote.commit(t, "index.html", "rc"))
+	remote.tag(t, "nightly-2.0.0", remote.commit(t, "index.html", "nightly"))
+	remote.tag(t, "3.0.0", remote.commit(t, "index.html", "unprefixed"))
+
+	tests := []struct {
+		filter   string
+		expected string
+	}{
+		{"", "3.0.0"},
+		{"v*", "v1.3.0-rc.1"},
+		{`/^v\d+\.\d+\.\d+$/`, "v1.2.3"},
+		{"nightly-*", ""},
+		{"/^release-/", ""},
+	}
+	for i, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Branch: latestTag})
+		repo.TagFilter = test.filter
+		err := repo.Pull()
+		if test.expected == "" {
+			// the filtered tags are not semantic versions
+			if err == nil {
+				t.Errorf("Test %v: expected no tag found %v", i, repo.latestTag)
+			}
+			continue
+		}
+		check(t, err)
+		if repo.latestTag != test.expected {
+			t.Errorf("Test %v: expected %v found %v", i, test.expected, repo.latestTag)
+		}
+	}
+}
+
+func TestPinnedTag(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	first := remote.commit(t, "index.html", "first")
+	remote.tag(t, "v1.0.0", first)
+	second := remote.commit(t, "index.html", "second")
+	remote.annotatedTag(t, "v2.0.0", second)
+	remote.commit(t, "index.html", "master")
+
+	tests := []struct {
+		tag     string
+		commit  string
+		content string
+	}{
+		{"v1.0.0", first, "first"},
+		{"v2.0.0", second, "second"},
+	}
+	for i, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+		repo.Tag = test.tag
+		check(t, repo.Pull())
+
+		if repo.lastCommit != test.commit {
+			t.Errorf("Test %v: expected commit %v found %v", i, test.commit, repo.lastCommit)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		if string(data) != test.content {
+			t.Errorf("Test %v: expected %q checked out found %q", i, test.content, data)
+		}
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.Tag = "v3.0.0"
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "tag v3.0.0 not found") {
+		t.Errorf("Expected missing tag error found %v", err)
+	}
+}
@@ -13,6 +13,11 @@ import (
 // TravisHook is webhook for travis-ci.org
 type TravisHook struct{}
 
+// RequiresSecret satisfies hookHandler.
+func (t TravisHook) RequiresSecret() bool {
+	return true
+}
+
 // DoesHandle satisfies hookHandler.
 func (t TravisHook) DoesHandle(h http.Header) bool {
 	return h.Get("Travis-Repo-Slug") != ""
@@ -24,7 +29,7 @@ func (t TravisHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method")
 	}
 	if err := t.handleSignature(r, repo.Hook.Secret); err != nil {
-		return http.StatusBadRequest, err
+		return http.StatusForbidden, err
 	}
 	if err := r.ParseForm(); err != nil {
 		return http.StatusBadRequest, err
@@ -44,19 +49,17 @@ func (t TravisHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 		err.err = fmt.Errorf("Ignoring payload with wrong status or type")
 		return 200, err
 	}
-	if repo.Branch != "" && data.Branch != repo.Branch {
-		err.err = fmt.Errorf("Ignoring push for branch %s", data.Branch)
-		return 200, err
+	if !repo.wantsRef("refs/heads/" + data.Branch) {
+		return 200, branchIgnored(t, data.Branch)
 	}
 
-	// attempt pull
-	if err := repo.Pull(); err != nil {
-		return http.StatusInternalServerError, err
-	}
-	if err := repo.checkoutCommit(data.Commit); err != nil {
-		return http.StatusInternalServerError, err
-	}
-	return 200, nil
+	// attempt pull of the built commit, pinned for this pull only
+	return hookStatus(pullHook(repo, func(pull func() error) error {
+		pinned := repo.Commit
+		repo.Commit = data.Commit
+		defer func() { repo.Commit = pinned }()
+		return pull()
+	}))
 }
 
 type travisPayload struct {
@@ -0,0 +1,107 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+)
+
+// infiniteDepth is the depth fetching the whole history,
+// as git fetch --unshallow does.
+const infiniteDepth = 0x7fffffff
+
+// depth returns the depth of the clones and fetches of r,
+// 0 for the whole history once unshallowed.
+func (r *Repo) depth() int {
+	if r.unshallowed {
+		return 0
+	}
+	return r.Depth
+}
+
+// unshallow fetches the history missing from the shallow clone of r.
+// go-git keeps the shallow commits recorded after deepening a clone,
+// they are forgotten once their parents are fetched. The repository
+// is cloned again without depth if the remote or go-git fail to deepen
+// it, recloned is then true. Other failures e.g. of the network leave
+// the shallow clone as is, to be deepened by the next pull.
+func (r *Repo) unshallow(ctx context.Context, gr *git.Repository) (recloned bool, err error) {
+	shallows, err := gr.Storer.Shallow()
+	if err != nil {
+		return false, err
+	}
+	r.unshallowed = true
+	if len(shallows) == 0 {
+		return false, nil
+	}
+
+	auth, err := r.auth()
+	if err != nil {
+		return false, err
+	}
+	r.logf(LogVerbose, "Fetching the history of %v.\n", r.label())
+	err = gr.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: r.remoteName(),
+		Auth:       auth,
+		Depth:      infiniteDepth,
+		Tags:       git.AllTags,
+		Progress:   r.progress(),
+	})
+	if err == nil || err == git.NoErrAlreadyUpToDate {
+		if hasParents(gr, shallows) {
+			Logger().Printf("%v unshallowed.\n", r.label())
+			return false, gr.Storer.SetShallow(nil)
+		}
+		err = errMissingHistory
+	}
+	if ctx.Err() != nil || (err != errMissingHistory && !missingShallowCapability(err)) {
+		r.unshallowed = false
+		return false, err
+	}
+
+	Logger().Printf("Unshallowing %v failed: %v. Cloning again.\n", r.label(), err)
+	return true, r.reclone(ctx)
+}
+
+// errMissingHistory is the error of a deepened clone still
+// missing the parents of its shallow commits.
+var errMissingHistory = errors.New("parents of the shallow commits not fetched")
+
+// isShallowError checks if err is a failure of go-git to update a
+// shallow clone, which a new clone fixes, rather than e.g. a network
+// or authentication error.
+func isShallowError(err error) bool {
+	switch err {
+	case plumbing.ErrObjectNotFound, object.ErrParentNotFound, packfile.ErrReferenceDeltaNotFound, errMissingHistory:
+		return true
+	}
+	return missingShallowCapability(err)
+}
+
+// missingShallowCapability checks if err is the failure of
+// a remote unable to serve shallow clones.
+func missingShallowCapability(err error) bool {
+	return strings.Contains(err.Error(), "missing capability "+capability.Shallow.String())
+}
+
+// hasParents checks if the parents of the commits are in gr.
+func hasParents(gr *git.Repository, commits []plumbing.Hash) bool {
+	for _, hash := range commits {
+		commit, err := gr.CommitObject(hash)
+		if err != nil {
+			return false
+		}
+		for _, parent := range commit.ParentHashes {
+			if _, err := gr.CommitObject(parent); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
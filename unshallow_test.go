@@ -0,0 +1,110 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestUnshallow(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+	second := remote.commit(t, "index.html", "second")
+	remote.commit(t, "index.html", "third")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	// the local server doesn't support shallow clones,
+	// the clone is marked shallow at the second commit
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	check(t, gr.Storer.SetShallow([]plumbing.Hash{plumbing.NewHash(second)}))
+	repo.Depth = 1
+	repo.Unshallow = true
+
+	check(t, repo.Pull())
+	if !repo.unshallowed {
+		t.Fatal("Expected repo unshallowed")
+	}
+	gr, err = gogit.PlainOpen(dir)
+	check(t, err)
+	if shallows, err := gr.Storer.Shallow(); err != nil || len(shallows) > 0 {
+		t.Errorf("Expected no shallow commit found %v %v", shallows, err)
+	}
+	head, err := gr.Head()
+	check(t, err)
+	iter, err := gr.Log(&gogit.LogOptions{From: head.Hash()})
+	check(t, err)
+	var n int
+	check(t, iter.ForEach(func(*object.Commit) error {
+		n++
+		return nil
+	}))
+	if n != 3 {
+		t.Errorf("Expected the whole history of 3 commits found %v", n)
+	}
+
+	// the next pulls fetch the whole history
+	opts, err := repo.pullOptions()
+	check(t, err)
+	if opts.Depth != 0 {
+		t.Errorf("Expected pulls without depth found %v", opts.Depth)
+	}
+}
+
+func TestUnshallowFailure(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+	second := remote.commit(t, "index.html", "second")
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir})
+	repo.MinInterval = 0
+	check(t, repo.Pull())
+
+	// the remote is unreachable
+	gr, err := gogit.PlainOpen(dir)
+	check(t, err)
+	shallows := []plumbing.Hash{plumbing.NewHash(second)}
+	check(t, gr.Storer.SetShallow(shallows))
+	check(t, gr.DeleteRemote(repo.remoteName()))
+	_, err = gr.CreateRemote(&config.RemoteConfig{Name: repo.remoteName(), URLs: []string{"failing://network/user/repo.git"}})
+	check(t, err)
+	repo.Depth = 1
+	repo.Unshallow = true
+
+	recloned, err := repo.unshallow(context.Background(), gr)
+	if err == nil || recloned {
+		t.Errorf("Expected failed unshallow without reclone found %v %v", recloned, err)
+	}
+	if repo.unshallowed {
+		t.Error("Expected unshallow retried by the next pull")
+	}
+	if found, err := gr.Storer.Shallow(); err != nil || len(found) != 1 {
+		t.Errorf("Expected shallow clone kept found %v %v", found, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "index.html")); err != nil || string(data) != "second" {
+		t.Errorf("Expected files kept found %q %v", data, err)
+	}
+}
@@ -0,0 +1,53 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Version is the version of the plugin.
+const Version = "0.1.0"
+
+// DefaultUserAgent is the User-Agent of the requests to the
+// http git servers without a configured one.
+const DefaultUserAgent = "caddy-puregit/" + Version
+
+// userAgents maps hosts to the User-Agent sent to them.
+var userAgents = newInstanceHosts()
+
+// setUserAgent sets the User-Agent of the git requests to host,
+// once the Caddy instance is in use.
+func setUserAgent(instance interface{}, host, userAgent string) error {
+	installHTTPClientOnce.Do(installHTTPClient)
+
+	if !userAgents.set(instance, host, userAgent) {
+		return fmt.Errorf("conflicting user agents for %v", host)
+	}
+	return nil
+}
+
+// userAgent returns the User-Agent to send to host.
+func userAgent(host string) string {
+	if ua, ok := userAgents.get(host); ok {
+		return ua
+	}
+	return DefaultUserAgent
+}
+
+// userAgentTransport sets the User-Agent of the requests
+// before sending them with next.
+type userAgentTransport struct {
+	next http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests must not be modified by round trippers
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("User-Agent", userAgent(req.URL.Hostname()))
+	return t.next.RoundTrip(r)
+}
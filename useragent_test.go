@@ -0,0 +1,83 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+)
+
+func TestUserAgent(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	var mu sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, r.UserAgent())
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	userAgents.use(t)
+	defer userAgents.remove(t)
+	check(t, setUserAgent(t, "127.0.0.1", "deploy-bot/2.0"))
+	if err := setUserAgent(t, "127.0.0.1", "other-bot/1.0"); err == nil {
+		t.Errorf("Expected error for conflicting user agents but found nil")
+	}
+
+	port := server.URL[strings.LastIndex(server.URL, ":"):]
+	for _, test := range []struct {
+		url       string
+		userAgent string
+	}{
+		{"http://127.0.0.1" + port + "/user/repo.git", "deploy-bot/2.0"},
+		{"http://localhost" + port + "/user/repo.git", DefaultUserAgent},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+
+		repo := &Repo{URL: RepoURL(test.url), Path: dir, Branch: "master"}
+		if err := repo.Pull(); err == nil {
+			t.Fatalf("Expected pull of a missing repository to fail")
+		}
+
+		mu.Lock()
+		if len(sent) == 0 || sent[0] != test.userAgent {
+			t.Errorf("Expected user agent %v for %v found %v", test.userAgent, test.url, sent)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestUserAgentReload(t *testing.T) {
+	old, reloaded, removed := new(int), new(int), new(int)
+	defer userAgents.remove(old)
+	defer userAgents.remove(reloaded)
+	defer userAgents.remove(removed)
+
+	userAgents.use(old)
+	check(t, setUserAgent(old, "git.reloaded.test", "deploy-bot/1.0"))
+
+	// a reload changes the user agent of the host
+	userAgents.use(reloaded)
+	check(t, setUserAgent(reloaded, "git.reloaded.test", "deploy-bot/2.0"))
+	if ua := userAgent("git.reloaded.test"); ua != "deploy-bot/2.0" {
+		t.Errorf("Expected user agent deploy-bot/2.0 after reload found %v", ua)
+	}
+
+	// a reload without the user_agent directive removes it
+	userAgents.use(removed)
+	if ua := userAgent("git.reloaded.test"); ua != DefaultUserAgent {
+		t.Errorf("Expected default user agent after reload found %v", ua)
+	}
+}
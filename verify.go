@@ -0,0 +1,57 @@
+package git
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// verifyCommit checks that the checked out commit r.lastCommit is signed
+// with the key of the armored public key file r.VerifyKey.
+func (r *Repo) verifyCommit() error {
+	key, err := gos.ReadFile(r.VerifyKey)
+	if err != nil {
+		return fmt.Errorf("cannot read verify key: %v", err)
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	if err != nil {
+		return err
+	}
+	commit, err := gr.CommitObject(plumbing.NewHash(r.lastCommit))
+	if err != nil {
+		return err
+	}
+
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("commit %v of %v is not signed", r.lastCommit, r.URL)
+	}
+	if _, err := commit.Verify(string(key)); err != nil {
+		return fmt.Errorf("commit %v of %v failed signature verification: %v", r.lastCommit, r.URL, err)
+	}
+	return nil
+}
+
+// rollback resets the worktree to commit after the new one failed
+// verification. The first clone can't be rolled back.
+func (r *Repo) rollback(commit string) {
+	if commit == "" {
+		Logger().Printf("Cannot roll back the first clone of %v.\n", r.label())
+		return
+	}
+
+	gr, err := git.PlainOpen(r.Path)
+	if err == nil {
+		var w *git.Worktree
+		if w, err = gr.Worktree(); err == nil {
+			err = w.Reset(&git.ResetOptions{Commit: plumbing.NewHash(commit), Mode: git.HardReset})
+		}
+	}
+	if err != nil {
+		Logger().Printf("Rolling back %v to %v failed: %v\n", r.label(), commit, err)
+		return
+	}
+	r.lastCommit = commit
+	Logger().Printf("%v rolled back to %v.\n", r.label(), commit)
+}
@@ -0,0 +1,76 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armoredPublicKey returns the armored public key of e.
+func armoredPublicKey(t *testing.T, e *openpgp.Entity) []byte {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	check(t, err)
+	check(t, e.Serialize(w))
+	check(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestVerifyKey(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	trusted, err := openpgp.NewEntity("deploy", "", "deploy@example.com", nil)
+	check(t, err)
+	forger, err := openpgp.NewEntity("forger", "", "deploy@example.com", nil)
+	check(t, err)
+
+	keyPath := "/etc/caddy/deploy.asc"
+	check(t, gittest.FakeOS.WriteFile(keyPath, armoredPublicKey(t, trusted), os.FileMode(0644)))
+
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	then := &countThen{}
+	repo := createRepo(&Repo{URL: remote.URL(), Path: dir, Then: []Then{then}})
+	repo.MinInterval = 0
+	repo.VerifyKey = keyPath
+
+	signed := remote.commitSigned(t, "index.html", "signed", trusted)
+	check(t, repo.Pull())
+	if then.n != 1 {
+		t.Fatalf("Expected then to run for a verified commit found %v executions", then.n)
+	}
+
+	for i, key := range []*openpgp.Entity{nil, forger} {
+		remote.commitSigned(t, "index.html", "unverified", key)
+		if err := repo.Pull(); err == nil {
+			t.Errorf("Test %v: expected verification error", i)
+		}
+		if then.n != 1 {
+			t.Errorf("Test %v: expected then not to run found %v executions", i, then.n)
+		}
+		if repo.lastCommit != signed {
+			t.Errorf("Test %v: expected roll back to %v found %v", i, signed, repo.lastCommit)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+		check(t, err)
+		if string(content) != "signed" {
+			t.Errorf("Test %v: expected worktree of the verified commit found %q", i, content)
+		}
+	}
+
+	signed = remote.commitSigned(t, "index.html", "signed again", trusted)
+	check(t, repo.Pull())
+	if then.n != 2 || repo.lastCommit != signed {
+		t.Errorf("Expected then to run for %v found %v executions at %v", signed, then.n, repo.lastCommit)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 )
@@ -19,6 +23,10 @@ type HookConfig struct {
 	URL    string // url to listen on for webhooks
 	Secret string // secret to validate hooks
 	Type   string // type of Webhook
+	Async  bool   // pull in background, answering 202 Accepted right away
+
+	AllowIPs       []string // IPs and CIDR blocks allowed to send webhooks, any if empty
+	TrustedProxies []string // IPs and CIDR blocks of the proxies setting X-Forwarded-For
 }
 
 // hookIgnoredError is returned when a webhook is ignored by the
@@ -26,6 +34,7 @@ type HookConfig struct {
 type hookIgnoredError struct {
 	hookType string
 	err      error
+	branch   string // pushed branch if ignored for not being the tracked one
 }
 
 // Error satisfies error interface
@@ -33,12 +42,217 @@ func (h hookIgnoredError) Error() string {
 	return fmt.Sprintf("%s webhook ignored. Error: %v", h.hookType, h.err)
 }
 
+// hookPullError is returned when the pull triggered by a webhook fails.
+type hookPullError struct {
+	err error
+}
+
+// Error satisfies error interface
+func (h hookPullError) Error() string {
+	return fmt.Sprintf("pull triggered by webhook failed. Error: %v", h.err)
+}
+
+// errPullQueued is returned by pullHook when the pull runs in background.
+var errPullQueued = errors.New("pull queued")
+
+// hookPull wraps the pull of a webhook, performed by calling pull,
+// e.g. to pull a released tag. It runs with the repo locked.
+type hookPull func(pull func() error) error
+
+// pullHook pulls repo for a webhook, wrapped by wrap if not nil. The
+// pull runs in background if the webhook is asynchronous, errPullQueued
+// is then returned.
+func pullHook(repo *Repo, wrap hookPull) error {
+	Logger().Print("Received pull notification for the tracking branch, updating...\n")
+	if repo.Hook.Async {
+		pullHookAsync(repo, wrap)
+		return errPullQueued
+	}
+	if err := repo.pullWith(wrap); err != nil {
+		return hookPullError{err}
+	}
+	return nil
+}
+
+// pullHookAsync pulls repo in background, wrapped by wrap if not nil.
+// Webhooks received while a pull is running queue a single pull to run
+// after it; those received while a pull is queued are covered by it and
+// dropped, their wrappers are applied to the queued pull.
+func pullHookAsync(repo *Repo, wrap hookPull) {
+	if wrap != nil {
+		repo.hookWrapsMu.Lock()
+		repo.hookWraps = append(repo.hookWraps, wrap)
+		repo.hookWrapsMu.Unlock()
+	}
+	if !atomic.CompareAndSwapInt32(&repo.hookQueued, 0, 1) {
+		return
+	}
+	go func() {
+		repo.hookMu.Lock()
+		defer repo.hookMu.Unlock()
+
+		// webhooks received from now on need another pull
+		atomic.StoreInt32(&repo.hookQueued, 0)
+		repo.hookWrapsMu.Lock()
+		wraps := repo.hookWraps
+		repo.hookWraps = nil
+		repo.hookWrapsMu.Unlock()
+
+		if err := repo.pullWith(chainHookPulls(wraps)); err != nil {
+			Logger().Println(hookPullError{err})
+		}
+	}()
+}
+
+// chainHookPulls returns the wrapper applying wraps in order,
+// nil if there is none.
+func chainHookPulls(wraps []hookPull) hookPull {
+	if len(wraps) == 0 {
+		return nil
+	}
+	return func(pull func() error) error {
+		next := chainHookPulls(wraps[1:])
+		if next == nil {
+			return wraps[0](pull)
+		}
+		return wraps[0](func() error { return next(pull) })
+	}
+}
+
+// hookStatus returns the response status for the error
+// returned by a webhook event handler.
+func hookStatus(err error) (int, error) {
+	if err == errPullQueued {
+		return http.StatusAccepted, nil
+	}
+	switch err.(type) {
+	case nil, hookIgnoredError:
+		return http.StatusOK, err
+	case hookPullError:
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusBadRequest, err
+}
+
 // hookIgnored checks if err is of type hookIgnoredError.
 func hookIgnored(err error) bool {
 	_, ok := err.(hookIgnoredError)
 	return ok
 }
 
+// branchIgnored returns the hookIgnoredError of h for a push to
+// branch, or tag, which is not pulled.
+func branchIgnored(h hookHandler, branch string) error {
+	return hookIgnoredError{
+		hookType: hookName(h),
+		err:      fmt.Errorf("found different branch %v", branch),
+		branch:   branch,
+	}
+}
+
+// deliveryWindow is how long the delivery ids of webhooks are
+// remembered to ignore redeliveries of the same event.
+const deliveryWindow = 10 * time.Minute
+
+// handleDelivery calls handle for the webhook delivery id of h unless
+// it was already received by repo, the webhook is then ignored. The id
+// is forgotten if the pull fails so the event can be delivered again.
+// An empty id is always handled.
+func handleDelivery(h hookHandler, repo *Repo, id string, handle func() error) error {
+	if id == "" {
+		return handle()
+	}
+	if !repo.addDelivery(id) {
+		return hookIgnoredError{
+			hookType: hookName(h),
+			err:      fmt.Errorf("duplicate delivery %v", id),
+		}
+	}
+	err := handle()
+	if _, ok := err.(hookPullError); ok {
+		repo.removeDelivery(id)
+	}
+	return err
+}
+
+// addDelivery records the webhook delivery id. It returns false
+// if id was already received within deliveryWindow.
+func (r *Repo) addDelivery(id string) bool {
+	r.deliveriesMu.Lock()
+	defer r.deliveriesMu.Unlock()
+
+	now := time.Now()
+	for d, t := range r.deliveries {
+		if now.Sub(t) > deliveryWindow {
+			delete(r.deliveries, d)
+		}
+	}
+	if _, ok := r.deliveries[id]; ok {
+		return false
+	}
+	if r.deliveries == nil {
+		r.deliveries = make(map[string]time.Time)
+	}
+	r.deliveries[id] = now
+	return true
+}
+
+// removeDelivery forgets the webhook delivery id.
+func (r *Repo) removeDelivery(id string) {
+	r.deliveriesMu.Lock()
+	delete(r.deliveries, id)
+	r.deliveriesMu.Unlock()
+}
+
+// pullPushedRef pulls repo for a push of ref e.g. refs/heads/master
+// or refs/tags/v1.0.0. The push is ignored if repo doesn't pull ref.
+func pullPushedRef(h hookHandler, repo *Repo, ref string) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	if name == "" || !strings.HasPrefix(ref, "refs/") {
+		return errors.New("the push request contained an invalid reference string")
+	}
+	if !repo.wantsRef(ref) {
+		return branchIgnored(h, name)
+	}
+	return pullHook(repo, nil)
+}
+
+// wantsRef checks if a push of ref e.g. refs/heads/master or
+// refs/tags/v1.0.0 may change the files pulled by r: its branch, one
+// of its additional branches, the tag it pins or a tag matching the
+// tags it follows, or the ref of its refspec.
+func (r *Repo) wantsRef(ref string) bool {
+	if r.RefSpec != "" && r.refSpec().Src() == ref {
+		return true
+	}
+	if strings.HasPrefix(ref, "refs/heads/") {
+		branch := strings.TrimPrefix(ref, "refs/heads/")
+		if branch == r.Branch {
+			return true
+		}
+		for _, b := range r.Branches {
+			if b.Branch == branch {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.HasPrefix(ref, "refs/tags/") {
+		return false
+	}
+	tag := strings.TrimPrefix(ref, "refs/tags/")
+	if tag == r.Tag {
+		return true
+	}
+	pattern, ok := r.tagPattern()
+	if !ok {
+		return false
+	}
+	filter, err := tagFilter(r.TagFilter)
+	matched, _ := path.Match(pattern, tag)
+	return matched && err == nil && filter(tag)
+}
+
 // hookName returns the name of the hookHanlder h.
 func hookName(h hookHandler) string {
 	for name, handler := range handlers {
@@ -52,6 +266,9 @@ func hookName(h hookHandler) string {
 // hookHandler is interface for specific providers to implement.
 type hookHandler interface {
 	DoesHandle(http.Header) bool
+	// RequiresSecret reports whether requests can only be
+	// validated with a secret configured for the hook.
+	RequiresSecret() bool
 	Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error)
 }
 
@@ -85,20 +302,24 @@ func (h WebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 
 	for _, repo := range h.Repos {
 
+		// hook urls are matched exactly, requests to
+		// other paths are passed on to the next handler
 		if r.URL.Path == repo.Hook.URL {
 
+			// rejected before reading the payload
+			if len(repo.Hook.AllowIPs) > 0 {
+				ip := clientIP(r, repo.Hook.TrustedProxies)
+				if !ipAllowed(ip, repo.Hook.AllowIPs) {
+					return http.StatusForbidden, fmt.Errorf("webhook from %v is not allowed", ip)
+				}
+			}
+
 			// if handler type is specified.
 			if handler, ok := handlers[repo.Hook.Type]; ok {
 				if !handler.DoesHandle(r.Header) {
 					return http.StatusBadRequest, errors.New(http.StatusText(http.StatusBadRequest))
 				}
-				status, err := handler.Handle(w, r, repo)
-				// if the webhook is ignored, log it and allow request to continue.
-				if hookIgnored(err) {
-					Logger().Println(err)
-					err = nil
-				}
-				return status, err
+				return serveHook(handler, w, r, repo)
 			}
 
 			// auto detect handler
@@ -107,13 +328,7 @@ func (h WebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				// we do not try other handlers. Only one handler ever
 				// handles a specific request.
 				if handlers[h].DoesHandle(r.Header) {
-					status, err := handlers[h].Handle(w, r, repo)
-					// if the webhook is ignored, log it and allow request to continue.
-					if hookIgnored(err) {
-						Logger().Println(err)
-						err = nil
-					}
-					return status, err
+					return serveHook(handlers[h], w, r, repo)
 				}
 			}
 
@@ -124,3 +339,40 @@ func (h WebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 
 	return h.Next.ServeHTTP(w, r)
 }
+
+// clientIP returns the ip of the client sending r. The X-Forwarded-For
+// header is only followed through the proxies in trusted: the ip is the
+// last forwarded one not sent by a trusted proxy.
+func clientIP(r *http.Request, trusted []string) string {
+	ip := hostOnly(r.RemoteAddr)
+	if len(trusted) == 0 || !ipAllowed(ip, trusted) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = strings.TrimSpace(forwarded[i])
+		if !ipAllowed(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// serveHook handles the request with handler.
+func serveHook(handler hookHandler, w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
+	status, err := handler.Handle(w, r, repo)
+	// if the webhook is ignored, log it and allow request to continue.
+	if hookIgnored(err) {
+		Logger().Println(err)
+		// tell the sender the push was received so it is not retried
+		if branch := err.(hookIgnoredError).branch; branch != "" && status == http.StatusOK {
+			w.Write([]byte("ignored branch " + branch))
+		}
+		err = nil
+	}
+	return status, err
+}
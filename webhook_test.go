@@ -0,0 +1,388 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/caddy-puregit/gittest"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// pulledRepo returns a repository tracking master which was just pulled,
+// pulls triggered by webhooks are skipped and succeed.
+func pulledRepo(hook HookConfig) *Repo {
+	return &Repo{Branch: "master", Hook: hook, MinInterval: time.Hour, lastPull: time.Now(), lastAttempt: time.Now()}
+}
+
+func TestWebHookIgnoredBranch(t *testing.T) {
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+
+	travisBody := url.Values{"payload": {`{"type": "push", "status_message": "Passed", "branch": "develop"}`}}.Encode()
+
+	for i, test := range []struct {
+		hookType string
+		secret   string
+		body     string
+		headers  map[string]string
+	}{
+		{"github", "", pushBranchBody, map[string]string{"User-Agent": "GitHub-Hookshot/abc", "X-Github-Event": "push"}},
+		{"gitlab", "", pushBranchBody, map[string]string{"X-Gitlab-Event": "Push Hook"}},
+		{"gogs", "", pushBranchBody, map[string]string{"X-Gitea-Event": "push"}},
+		{"gitee", "", pushBranchBody, map[string]string{"X-Gitee-Event": "Push Hook"}},
+		{"generic", "", pushBranchBody, nil},
+		{"bitbucket", "10.0.0.1", pushBBBranchBody, map[string]string{"X-Event-Key": "repo:push"}},
+		{"travis", "", travisBody, map[string]string{
+			"Travis-Repo-Slug": "user/repo",
+			"Authorization":    "signature",
+			"Content-Type":     "application/x-www-form-urlencoded",
+		}},
+		// auto detected
+		{"", "", pushBranchBody, map[string]string{"X-Gitlab-Event": "Push Hook"}},
+	} {
+		repo := &Repo{Branch: "master", Hook: HookConfig{URL: "/hook", Type: test.hookType, Secret: test.secret}}
+		hook := WebHook{Repos: []*Repo{repo}, Next: next}
+
+		req, err := http.NewRequest("POST", "/hook", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		code, err := hook.ServeHTTP(rec, req)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found %v", i, err)
+		}
+		if code != http.StatusOK {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, http.StatusOK, code)
+		}
+		if body := rec.Body.String(); body != "ignored branch develop" {
+			t.Errorf("Test %d: Expected response body to be 'ignored branch develop' but was '%v'", i, body)
+		}
+		if repo.pulled {
+			t.Errorf("Test %d: Expected no pull for an ignored branch", i)
+		}
+	}
+}
+
+var pushBranchBody = `
+{
+  "ref": "refs/heads/develop"
+}
+`
+
+var pushBBBranchBody = `
+{
+	"push": {
+		"changes": [
+			{
+				"new": {
+					"type": "branch",
+					"name": "develop"
+				}
+			}
+		]
+	}
+}
+`
+
+func TestWantsRef(t *testing.T) {
+	tests := []struct {
+		repo  *Repo
+		ref   string
+		wants bool
+	}{
+		{&Repo{Branch: "master"}, "refs/heads/master", true},
+		{&Repo{Branch: "master"}, "refs/heads/develop", false},
+		{&Repo{Branch: "master"}, "refs/tags/v1.0.0", false},
+		{&Repo{Branch: "master", Branches: []*BranchSpec{{Branch: "staging", Path: "/preview"}}}, "refs/heads/staging", true},
+		{&Repo{Branch: "master", Tag: "v1.0.0"}, "refs/tags/v1.0.0", true},
+		{&Repo{Branch: "master", Tag: "v1.0.0"}, "refs/tags/v1.0.1", false},
+		{&Repo{Branch: latestTag}, "refs/tags/v1.0.1", true},
+		{&Repo{Branch: "v1.*"}, "refs/tags/v1.2.0", true},
+		{&Repo{Branch: "v1.*"}, "refs/tags/v2.0.0", false},
+		{&Repo{Branch: latestTag, TagFilter: "/^v[0-9.]+$/"}, "refs/tags/v2.0.0-rc.1", false},
+		{&Repo{Branch: "master", RefSpec: "refs/pull/123/head"}, "refs/pull/123/head", true},
+		{&Repo{Branch: "master", RefSpec: "refs/pull/123/head"}, "refs/pull/124/head", false},
+	}
+
+	for i, test := range tests {
+		if wants := test.repo.wantsRef(test.ref); wants != test.wants {
+			t.Errorf("Test %v: Expected %v pulled %v found %v", i, test.ref, test.wants, wants)
+		}
+	}
+}
+
+func TestWebHookStatus(t *testing.T) {
+	remote := newRemote(t)
+	defer os.RemoveAll(remote.dir)
+	remote.commit(t, "index.html", "first")
+
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+
+	for i, test := range []struct {
+		url    RepoURL
+		event  string
+		body   string
+		secret string
+		code   int
+		pulled bool
+	}{
+		{remote.URL(), "push", pushMasterBody, "supersecret", http.StatusOK, true},
+		{remote.URL(), "push", pushBranchBody, "supersecret", http.StatusOK, false},
+		{remote.URL(), "ping", "", "supersecret", http.StatusOK, false},
+		{remote.URL(), "push", "{", "supersecret", http.StatusBadRequest, false},
+		{remote.URL(), "push", pushMasterBody, "wrongsecret", http.StatusForbidden, false},
+		{remote.URL() + ".missing", "push", pushMasterBody, "supersecret", http.StatusInternalServerError, false},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repo := &Repo{
+			URL:    test.url,
+			Path:   dir,
+			Branch: "master",
+			Hook:   HookConfig{URL: "/hook", Type: "github", Secret: "supersecret"},
+		}
+		hook := WebHook{Repos: []*Repo{repo}, Next: next}
+
+		req, err := http.NewRequest("POST", "/hook", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+		req.Header.Set("X-Github-Event", test.event)
+		req.Header.Set("X-Hub-Signature-256", ghSign(sha256.New, "sha256=", test.body, test.secret))
+
+		code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+		if repo.pulled != test.pulled {
+			t.Errorf("Test %d: Expected pulled to be %v but was %v", i, test.pulled, repo.pulled)
+		}
+	}
+}
+
+func TestWebHookAsync(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+	atomic.StoreInt32(&blockingUploads, 0)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// pulls block until cancelled
+	repo := &Repo{
+		URL:    "blocking://example.com/user/repo.git",
+		Path:   dir,
+		Branch: "master",
+		Hook:   HookConfig{URL: "/hook", Type: "github", Secret: "supersecret", Async: true},
+	}
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	push := func() int {
+		req, err := http.NewRequest("POST", "/hook", bytes.NewBufferString(pushMasterBody))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", ghSign(sha256.New, "sha256=", pushMasterBody, "supersecret"))
+
+		code, err := hook.ServeHTTP(httptest.NewRecorder(), req)
+		check(t, err)
+		return code
+	}
+
+	start := time.Now()
+	if code := push(); code != http.StatusAccepted {
+		t.Errorf("Expected response code %v found %v", http.StatusAccepted, code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected response before the end of the pull, took %v", d)
+	}
+
+	time.Sleep(time.Second / 5)
+	if n := atomic.LoadInt32(&blockingUploads); n != 1 {
+		t.Errorf("Expected a single pull found %v", n)
+	}
+
+	// webhooks received during the pull are queued, not run concurrently
+	for i := 0; i < 2; i++ {
+		if code := push(); code != http.StatusAccepted {
+			t.Errorf("Expected response code %v found %v", http.StatusAccepted, code)
+		}
+	}
+	time.Sleep(time.Second / 5)
+	if n := atomic.LoadInt32(&blockingUploads); n != 1 {
+		t.Errorf("Expected a single pull running found %v", n)
+	}
+
+	// abort the running pull, then the queued one
+	repo.Cancel()
+	time.Sleep(time.Second / 5)
+	repo.Cancel()
+	repo.hookMu.Lock()
+	repo.hookMu.Unlock()
+}
+
+func TestWebHookAsyncWraps(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	repo := pulledRepo(HookConfig{URL: "/hook", Async: true})
+
+	// the pulls are queued behind a running one
+	var mu sync.Mutex
+	var wrapped []string
+	wrap := func(name string) hookPull {
+		return func(pull func() error) error {
+			mu.Lock()
+			wrapped = append(wrapped, name)
+			mu.Unlock()
+			return pull()
+		}
+	}
+	repo.hookMu.Lock()
+	pullHookAsync(repo, wrap("release"))
+	pullHookAsync(repo, nil)
+	pullHookAsync(repo, wrap("travis"))
+	repo.hookMu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(wrapped)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(wrapped, ",") != "release,travis" {
+		t.Errorf("Expected the wrappers of the dropped webhooks applied to the queued pull found %v", wrapped)
+	}
+}
+
+func TestWebHookAllowIP(t *testing.T) {
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	repo := pulledRepo(HookConfig{
+		URL:            "/hook",
+		Type:           "github",
+		Secret:         "supersecret",
+		AllowIPs:       []string{"192.30.252.0/22", "2a0a:a440::/29"},
+		TrustedProxies: []string{"10.0.0.1"},
+	})
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	for i, test := range []struct {
+		remoteAddr string
+		forwarded  string
+		code       int
+	}{
+		{"192.30.252.10:4321", "", http.StatusOK},
+		{"[2a0a:a440::1]:4321", "", http.StatusOK},
+		{"203.0.113.7:4321", "", http.StatusForbidden},
+		// forwarded for an allowed ip by an untrusted proxy
+		{"203.0.113.7:4321", "192.30.252.10", http.StatusForbidden},
+		{"10.0.0.1:4321", "192.30.252.10", http.StatusOK},
+		{"10.0.0.1:4321", "203.0.113.7", http.StatusForbidden},
+		// only the ip set by the trusted proxy is used
+		{"10.0.0.1:4321", "192.30.252.10, 203.0.113.7", http.StatusForbidden},
+		{"10.0.0.1:4321", "", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("POST", "/hook", bytes.NewBufferString(pushMasterBody))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		req.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", ghSign(sha256.New, "sha256=", pushMasterBody, "supersecret"))
+
+		code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+	}
+}
+
+var pushMasterBody = `
+{
+  "ref": "refs/heads/master"
+}
+`
+
+func TestWebHookDispatch(t *testing.T) {
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+
+	var repos []*Repo
+	for _, url := range []string{"/hook/site", "/hook/docs"} {
+		remote := newRemote(t)
+		defer os.RemoveAll(remote.dir)
+		remote.commit(t, "index.html", url)
+
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		repos = append(repos, &Repo{
+			URL:    remote.URL(),
+			Path:   dir,
+			Branch: "master",
+			Hook:   HookConfig{URL: url, Type: "generic"},
+		})
+	}
+	hook := WebHook{Repos: repos, Next: next}
+
+	for i, test := range []struct {
+		path   string
+		code   int
+		pulled []bool
+	}{
+		{"/hook", http.StatusNotFound, []bool{false, false}},
+		{"/hook/site/other", http.StatusNotFound, []bool{false, false}},
+		{"/hook/docs", http.StatusOK, []bool{false, true}},
+		{"/hook/site", http.StatusOK, []bool{true, true}},
+	} {
+		req, err := http.NewRequest("POST", test.path, bytes.NewBufferString(pushMasterBody))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+
+		code, err := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found %v", i, err)
+		}
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+		for j, repo := range repos {
+			if repo.pulled != test.pulled[j] {
+				t.Errorf("Test %d: Expected repo %d pulled to be %v but was %v", i, j, test.pulled[j], repo.pulled)
+			}
+		}
+	}
+}